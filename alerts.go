@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+type SavedSearch struct {
+	Id           int
+	Query        string
+	Created      int
+	CheckedUntil int // revisions retrieved up to this date were already checked
+	NewHits      int
+}
+
+// A revision that matched a saved search
+type SearchHit struct {
+	SearchId      int
+	Query         string
+	UrlId         int
+	Url           string
+	Title         string
+	RetrievedDate int
+	Found         int
+}
+
+// Returns the saved searches of the archive, ok is false if its store can not keep them
+func savedSearchStore() (SavedSearchStore, bool) {
+	s, ok := archive.(SavedSearchStore)
+	return s, ok
+}
+
+// Saves the search q, it will only match revisions retrieved from now on
+func addSavedSearch(q string) (int, error) {
+	if _, err := parseQuery(q); err != nil {
+		return 0, err
+	}
+	s, ok := savedSearchStore()
+	if !ok {
+		return 0, fmt.Errorf("the store of this archive can not save searches")
+	}
+	return s.AddSavedSearch(q, int(time.Now().Unix())), nil
+}
+
+func removeSavedSearch(id int) {
+	if s, ok := savedSearchStore(); ok {
+		s.RemoveSavedSearch(id)
+	}
+}
+
+func listSavedSearches() []SavedSearch {
+	s, ok := savedSearchStore()
+	if !ok {
+		return []SavedSearch{}
+	}
+	return s.ListSavedSearches()
+}
+
+// Runs every saved search on the revisions retrieved since it was last checked and records what they matched, returns the number of new hits
+func checkSavedSearches() int {
+	s, ok := savedSearchStore()
+	if !ok {
+		return 0
+	}
+	hits := 0
+	now := int(time.Now().Unix())
+	for _, ss := range s.ListSavedSearches() {
+		sq, err := parseQuery(ss.Query)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Saved search %d %q: %v\n", ss.Id, ss.Query, err)
+			continue
+		}
+		sq.filters = append(sq.filters, queryFilter{Kind: FILTER_AFTER, Date: ss.CheckedUntil})
+		results, _, err := archive.Search(sq, 0, -1)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Saved search %d %q: %v\n", ss.Id, ss.Query, err)
+			continue
+		}
+		for _, res := range results {
+			urlId, err := strconv.Atoi(res.UrlId)
+			if err != nil {
+				continue
+			}
+			for _, date := range res.Dates {
+				if s.AddSearchHit(ss.Id, urlId, date, now) {
+					hits++
+				}
+			}
+		}
+		s.SetSearchChecked(ss.Id, now)
+	}
+	return hits
+}
+
+// Lists the hits of saved searches not marked as seen, newest first
+func listNewHits() []SearchHit {
+	s, ok := savedSearchStore()
+	if !ok {
+		return []SearchHit{}
+	}
+	return s.ListNewHits()
+}
+
+func markHitsSeen() {
+	if s, ok := savedSearchStore(); ok {
+		s.MarkHitsSeen()
+	}
+}
+
+// Prints the new hits of saved searches and marks them as seen, or manages the saved searches
+func alertsCmd(args []string) {
+	if len(args) == 0 {
+		hits := listNewHits()
+		for _, h := range hits {
+			fmt.Printf("%s\t%d\t%s\t%s\t%s\n", h.Query, h.UrlId, h.Url, h.Title, time.Unix(int64(h.RetrievedDate), 0).Format("2006-01-02"))
+		}
+		markHitsSeen()
+		fmt.Fprintf(os.Stderr, "%d new matches\n", len(hits))
+		return
+	}
+
+	switch args[0] {
+	case "add":
+		if len(args) != 2 {
+			usage()
+		}
+		id, err := addSavedSearch(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Bad query: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Saved search %d\n", id)
+	case "remove":
+		if len(args) != 2 {
+			usage()
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			usage()
+		}
+		removeSavedSearch(id)
+	case "list":
+		for _, ss := range listSavedSearches() {
+			fmt.Printf("%d\t%s\t%d new matches\n", ss.Id, ss.Query, ss.NewHits)
+		}
+	default:
+		usage()
+	}
+}
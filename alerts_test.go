@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckSavedSearches(t *testing.T) {
+	openTestArchive(t, "")
+	now := int(time.Now().Unix())
+	testUrl("https://example.com/old", false, now-100, "Old", "apples")
+
+	id, err := addSavedSearch("apples -pears")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := addSavedSearch("site:"); err == nil {
+		t.Errorf("bad query saved")
+	}
+	if n := checkSavedSearches(); n != 0 {
+		t.Errorf("%d hits for revisions retrieved before the search was saved", n)
+	}
+
+	testUrl("https://example.com/new", false, now+100, "New", "apples")
+	testUrl("https://example.com/pears", false, now+100, "Pears", "apples and pears")
+	if n := checkSavedSearches(); n != 1 {
+		t.Errorf("%d hits, want 1", n)
+	}
+	if n := checkSavedSearches(); n != 0 {
+		t.Errorf("%d hits when checking again, want 0", n)
+	}
+
+	hits := listNewHits()
+	if len(hits) != 1 || hits[0].SearchId != id || hits[0].Url != "https://example.com/new" || hits[0].Title != "New" {
+		t.Errorf("new hits are %+v", hits)
+	}
+	if ss := listSavedSearches(); len(ss) != 1 || ss[0].NewHits != 1 {
+		t.Errorf("saved searches are %+v", ss)
+	}
+	markHitsSeen()
+	if hits := listNewHits(); len(hits) != 0 {
+		t.Errorf("%d new hits after marking them seen", len(hits))
+	}
+	removeSavedSearch(id)
+	if ss := listSavedSearches(); len(ss) != 0 {
+		t.Errorf("saved searches after removing them are %+v", ss)
+	}
+}
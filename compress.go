@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+)
+
+// Compression codecs for stored content and additional resources
+const CODEC_NONE = "none"
+const CODEC_GZIP = "gzip"
+const CODEC_ZSTD = "zstd"
+
+var zstdEncoder, zstdDecoder = newZstd()
+
+func newZstd() (*zstd.Encoder, *zstd.Decoder) {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	must(err)
+	dec, err := zstd.NewReader(nil)
+	must(err)
+	return enc, dec
+}
+
+// Compresses c with the codec selected on the command line if the compressed version is going to be significantly shorter
+func maybeCompress(c []byte) (cc []byte, codec string) {
+	var bs []byte
+	switch compressFlag {
+	case CODEC_GZIP:
+		bw := bytes.NewBuffer([]byte{})
+		gw, _ := gzip.NewWriterLevel(bw, gzip.BestCompression)
+		gw.Write(c)
+		gw.Close()
+		bs = bw.Bytes()
+	default:
+		bs = zstdEncoder.EncodeAll(c, nil)
+	}
+
+	if len(bs) < int(float32(len(c))*MINGAIN) {
+		return bs, compressFlag
+	} else {
+		return []byte(c), CODEC_NONE
+	}
+}
+
+// Decompresses a, which was compressed with codec
+func decompress(a []byte, codec string) []byte {
+	switch codec {
+	case CODEC_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(a))
+		must(err)
+		defer r.Close()
+		x, err := ioutil.ReadAll(r)
+		must(err)
+		return x
+	case CODEC_ZSTD:
+		x, err := zstdDecoder.DecodeAll(a, nil)
+		must(err)
+		return x
+	default:
+		return a
+	}
+}
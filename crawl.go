@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"net/url"
+	"strings"
+)
+
+// Number of subpages crawled when a crawl depth is set without a page cap
+const DEFAULT_CRAWL_PAGES = 50
+
+type crawlItem struct {
+	url   string
+	depth int
+}
+
+// Archives the pages linked from parent that are on the same host and below the same path, up to the crawl depth and page cap configured for parent.
+// Subpages are stored with the same importance as parent.
+func crawl(parent Url) {
+	depth, maxPages, ok := parent.GetCrawlConfig()
+	if !ok || depth <= 0 {
+		return
+	}
+
+	prefix, ok := crawlPrefix(parent.Url)
+	if !ok {
+		return
+	}
+
+	visited := map[string]bool{parent.Url: true}
+	queue := []crawlItem{{parent.Url, 0}}
+	pages := 0
+
+	for len(queue) > 0 {
+		item := queue[0]
+		queue = queue[1:]
+
+		if item.depth >= depth {
+			continue
+		}
+
+		u, ok := getUrlByUrl(item.url)
+		if !ok {
+			continue
+		}
+		content, _, ok := u.GetContent(-1)
+		if !ok {
+			continue
+		}
+
+		for _, link := range pageLinks(item.url, content) {
+			if visited[link] || !strings.HasPrefix(link, prefix) {
+				continue
+			}
+			visited[link] = true
+
+			if pages >= maxPages || interrupted() {
+				return
+			}
+			pages++
+
+			if parent.IsImportant {
+				fmt.Printf("\tGetting important subpage: %s\n", link)
+			} else {
+				fmt.Printf("\tGetting unimportant subpage: %s\n", link)
+			}
+			addSubpage := func(sub Url) {
+				parent.AddSubpage(sub)
+			}
+			var res fetchResult
+			if parent.IsImportant {
+				_, res = importantUrl(link, addSubpage)
+			} else {
+				_, res = unimportantUrl(link, parent.LastVisit, addSubpage)
+			}
+			// the links of pages that were skipped or didn't change were followed when they were stored
+			if res == FETCH_STORED {
+				queue = append(queue, crawlItem{link, item.depth + 1})
+			}
+		}
+	}
+}
+
+// Returns the prefix that links must have to be crawled from pageUrl: same scheme and host, and a path below the directory of pageUrl
+func crawlPrefix(pageUrl string) (string, bool) {
+	u, err := url.Parse(pageUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", false
+	}
+	dir := u.Path
+	if idx := strings.LastIndex(dir, "/"); idx >= 0 {
+		dir = dir[:idx+1]
+	} else {
+		dir = "/"
+	}
+	return u.Scheme + "://" + u.Host + dir, true
+}
+
+// Returns the absolute urls of all links in content, without fragments
+func pageLinks(pageUrl string, content []byte) []string {
+	root, err := html.Parse(bytes.NewReader(content))
+	if err != nil {
+		return nil
+	}
+	links := []string{}
+	pageLinksRecur(pageUrl, root, &links)
+	return links
+}
+
+func pageLinksRecur(pageUrl string, node *html.Node, links *[]string) {
+	for n := node; n != nil; n = n.NextSibling {
+		if n.Type == html.ElementNode && n.DataAtom == atom.A {
+			for _, attr := range n.Attr {
+				if strings.ToLower(attr.Key) != "href" {
+					continue
+				}
+				u, err := url.Parse(resolveUrl(pageUrl, strings.TrimSpace(attr.Val)))
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+					continue
+				}
+				u.Fragment = ""
+				*links = append(*links, u.String())
+			}
+		}
+		if n.FirstChild != nil {
+			pageLinksRecur(pageUrl, n.FirstChild, links)
+		}
+	}
+}
@@ -3,17 +3,16 @@ package main
 import (
 	"bytes"
 	"code.google.com/p/gosqlite/sqlite"
-	"compress/gzip"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"github.com/kr/binarydist"
 	"io"
-	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
-	"strconv"
-	"sync"
+	"strings"
 	"time"
 )
 
@@ -30,7 +29,9 @@ type Url struct {
 
 type Revision struct {
 	RetrievedDate int
-	IsGz, IsDiff  bool
+	Codec         string
+	IsDiff        bool
+	Encoding      string
 	Size          int
 }
 
@@ -42,105 +43,45 @@ func hasTable(name string) bool {
 	return stmt.Next()
 }
 
-func createDatabase() (err error) {
-	err = dbConn.Exec(`CREATE TABLE IF NOT EXISTS urls (
-		id integer primary key autoincrement not null,
-		url text not null,
-		important boolean not null,
-		last_visit date not null
-	)`)
-	if err != nil {
-		return
-	}
-	err = dbConn.Exec(`CREATE TABLE IF NOT EXISTS content (
-		url_id integer not null,
-		isdiff boolean not null,
-		isgz boolean not null,
-		retrieved date not null,
-		content blob not null
-	)`)
-	if err != nil {
-		return
-	}
-
-	err = dbConn.Exec(`CREATE TABLE IF NOT EXISTS additional (
-		contentid text primary key not null,
-		url text not null,
-		contenttype text not null,
-		content blob not null
-	)`)
-
-	if !hasTable("content2idx") {
-		err = dbConn.Exec(`CREATE VIRTUAL TABLE content2idx USING fts3(
-			url_id integer primary key autoincrement not null, 
-			title text,
-			ttext text
-		)`)
-		if err != nil {
-			return
-		}
-	}
-
-	return
-}
-
-// Compresses c if the compressed version is going to be significantly shorter
-func maybeCompress(c []byte) (cc []byte, isgz bool) {
-	bw := bytes.NewBuffer([]byte{})
-	gw, _ := gzip.NewWriterLevel(bw, gzip.BestCompression)
-	gw.Write(c)
-	gw.Close()
-	bs := bw.Bytes()
-
-	if len(bs) < int(float32(len(c))*MINGAIN) {
-		return bs, true
-	} else {
-		return []byte(c), false
-	}
-}
-
-func uncompress(a []byte) []byte {
-	r, err := gzip.NewReader(bytes.NewReader(a))
-	must(err)
-	defer r.Close()
-	x, err := ioutil.ReadAll(r)
+func hasColumn(table, name string) bool {
+	stmt, err := dbConn.Prepare("SELECT name FROM pragma_table_info(?) WHERE name = ?")
 	must(err)
-	return x
+	defer stmt.Finalize()
+	must(stmt.Exec(table, name))
+	return stmt.Next()
 }
 
-// Creates a diff from o to c then compresses it. Both operations are done only if the result is significantly shorter.
+// Creates a diff from o to c, using the specified encoding, then compresses it. Both operations are done only if the result is significantly shorter.
 // The function will just return c uncompressed if it's the shortest solution
-func maybeDiffCompress(c, o []byte) (cc []byte, isdiff bool, isgz bool) {
+func maybeDiffCompress(c, o []byte, encoding string) (cc []byte, isdiff bool, codec string) {
 	if debugProcessing {
 		fmt.Printf("\tContent is %d/%d bytes, diffing\n", len(o), len(c))
 	}
-	patch := bytes.NewBuffer([]byte{})
-	binarydist.Diff(bytes.NewReader(o), bytes.NewReader(c), patch)
-	db := patch.Bytes()
+	db := diff(c, o, encoding)
 	if len(db) < int(float32(len(c))*MINGAIN) {
 		if debugProcessing {
 			fmt.Printf("\tCompressing diff\n")
 		}
-		dbc, isgz := maybeCompress(db)
+		dbc, codec := maybeCompress(db)
 		if debugProcessing {
 			fmt.Printf("\tDone\n")
 		}
-		return dbc, true, isgz
+		return dbc, true, codec
 	} else {
 		if debugProcessing {
 			fmt.Printf("\tCompressing original\n")
 		}
-		cc, isgz := maybeCompress([]byte(c))
+		cc, codec := maybeCompress([]byte(c))
 		if debugProcessing {
 			fmt.Printf("\tDone\n")
 		}
-		return cc, false, isgz
+		return cc, false, codec
 	}
 }
 
 func patch(base []byte, changes []byte) []byte {
 	new := bytes.NewBuffer([]byte{})
-	binarydist.Patch(bytes.NewReader(base), new, bytes.NewReader(changes))
+	must(binarydist.Patch(bytes.NewReader(base), new, bytes.NewReader(changes)))
 	return new.Bytes()
 }
 
@@ -174,245 +115,262 @@ func writeVarint(w io.Writer, x int, buf []byte) {
 
 // Returns most recent stored version of the url's content and the number of diffs since the last full storage
 func (u *Url) GetContent(atDate int) ([]byte, int, bool) {
-	var stmt *sqlite.Stmt
-	var err error
+	return archive.GetContent(u, atDate)
+}
 
-	if atDate < 0 {
-		stmt, err = dbConn.Prepare("select isgz, retrieved, content  from content where url_id = ? and isdiff = 0 order by retrieved desc limit 1")
-	} else {
-		stmt, err = dbConn.Prepare("select isgz, retrieved, content  from content where url_id = ? and isdiff = 0 and retrieved <= ? order by retrieved desc limit 1")
-	}
-	must(err)
-	defer stmt.Finalize()
-	if atDate < 0 {
-		must(stmt.Exec(u.Id))
+// Stores a new version of the content for u, compressed with codec. encoding is the diff encoding used if isdiff is set, hash is the contentAddressableId of the reconstructed revision. if newRecord is true the new version will be inserted, otherwise we will just update the (single) record for the url. Returns the retrieval date of the new version
+func (u *Url) StoreContent(cc []byte, isdiff bool, codec, encoding, hash string, newRecord bool) int {
+	rev := StoredRevision{Revision{int(time.Now().Unix()), codec, isdiff, encoding, len(cc)}, hash, cc, nil}
+	if newRecord {
+		archive.InsertRevision(u, rev)
 	} else {
-		must(stmt.Exec(u.Id, atDate))
-	}
-	if !stmt.Next() {
-		return []byte{}, 0, false
+		archive.UpdateRevision(u, rev)
+		archive.DeleteStaleText(u)
 	}
+	return rev.RetrievedDate
+}
+
+// Inserts a new record of content for u, retrieved at the specified date
+func (u *Url) StoreContentAt(cc []byte, isdiff bool, codec, encoding, hash string, retrieved int) {
+	archive.InsertRevision(u, StoredRevision{Revision{retrieved, codec, isdiff, encoding, len(cc)}, hash, cc, nil})
+}
 
-	var isgz bool
-	var retrievedDate int
-	var baseContent []byte
+// Stores the text extracted from the revision of u retrieved at retrieved in the full text index, with the stems of its words in its language
+func (u *Url) StoreContent2(retrieved int, title, text string) {
+	language := detectLanguage(title + "\n" + text)
+	archive.StoreText(u, retrieved, title, text, language, stemText(language, title+"\n"+text))
+}
 
-	stmt.Scan(&isgz, &retrievedDate, &baseContent)
+func (u *Url) GetContent2() (title, text, language string, ok bool) {
+	return archive.GetText(u)
+}
 
-	if isgz {
-		baseContent = uncompress(baseContent)
-	}
+// Gets informations pertaining url if present, otherwise adds it to the database
+func Lookup(url string, important bool, lastVisit int) Url {
+	return archive.Lookup(url, important, lastVisit)
+}
 
-	n := 0
-	var stmt2 *sqlite.Stmt
+// Returns the id of url if it is archived
+func findUrlId(url string) (id int, ok bool) {
+	return archive.FindUrl(url)
+}
 
-	if atDate < 0 {
-		stmt2, err = dbConn.Prepare("select isgz, content from content where url_id = ? and isdiff = 1 and retrieved > ? order by retrieved asc")
-	} else {
-		stmt2, err = dbConn.Prepare("select isgz, content from content where url_id = ? and isdiff = 1 and retrieved > ? and retrieved <= ? order by retrieved asc")
-	}
+// Lists all urls except the subpages retrieved crawling other urls
+func listUrls() []Url {
+	return archive.ListUrls()
+}
 
-	must(err)
-	defer stmt2.Finalize()
-	if atDate < 0 {
-		must(stmt2.Exec(u.Id, retrievedDate))
-	} else {
-		must(stmt2.Exec(u.Id, retrievedDate, atDate))
+func getUrl(id int) (Url, bool) {
+	return archive.GetUrl(id)
+}
+
+func getUrlByUrl(url string) (r Url, ok bool) {
+	id, ok := findUrlId(url)
+	if !ok {
+		return r, false
 	}
-	for stmt.Next() {
-		var content []byte
-		stmt2.Scan(&isgz, &content)
-		if isgz {
-			content = uncompress(content)
-		}
-		baseContent = patch(baseContent, content)
-		n++
+	return getUrl(id)
+}
+
+// Returns the crawl depth and page cap for u, ok is false if they were never set
+func (u *Url) GetCrawlConfig() (depth, maxPages int, ok bool) {
+	depth, maxPages, ok = archive.GetCrawlConfig(u)
+	if !ok {
+		return 0, DEFAULT_CRAWL_PAGES, false
 	}
+	return depth, maxPages, true
+}
 
-	return baseContent, n, true
+func (u *Url) SetCrawlConfig(depth, maxPages int) {
+	archive.SetCrawlConfig(u, depth, maxPages)
 }
 
-// Stores a new version of the content for u. if newRecord is true the new version will be inserted, otherwise we will just update the (single) record for the url
-func (u *Url) StoreContent(cc []byte, isdiff, isgz, newRecord bool) {
-	if newRecord {
-		must(dbConn.Exec("insert into content (url_id, isdiff, isgz, retrieved, content) values (?, ?, ?, ?, ?)", u.Id, isdiff, isgz, time.Now().Unix(), cc))
-	} else {
-		must(dbConn.Exec("update content set isdiff = ?, isgz = ?, retrieved = ?, content = ? where url_id = ?", isdiff, isgz, time.Now().Unix(), cc, u.Id))
-	}
+// Replaces the tags of u
+func (u *Url) SetTags(tags []string) {
+	archive.SetTags(u, tags)
 }
 
-func (u *Url) StoreContent2(title, text string) {
-	must(dbConn.Exec("insert or replace into content2idx (url_id, title, ttext) values (?, ?, ?)", u.Id, title, text))
+func (u *Url) Tags() []string {
+	return archive.Tags(u)
 }
 
-func (u *Url) GetContent2() (title string, text string, ok bool) {
-	stmt, err := dbConn.Prepare("select title, ttext from content2idx where url_id = ?")
-	must(err)
-	defer stmt.Finalize()
-	must(stmt.Exec(u.Id))
-	if !stmt.Next() {
-		ok = false
-		return
+// Records the content type of u, detected from the content of its last revision
+func (u *Url) SetContentType(content []byte) {
+	mt, _, err := mime.ParseMediaType(http.DetectContentType(content))
+	if err != nil {
+		mt = ""
 	}
-	must(stmt.Scan(&title, &text))
-	ok = true
-	return
+	archive.SetContentType(u, mt)
 }
 
-// Gets informations pertaining url if present, otherwise adds it to the database
-func Lookup(url string, important bool, lastVisit int, recur bool) (r Url) {
-	r.Url = url
-	stmt, err := dbConn.Prepare("select id, important, last_visit from urls where url = ?")
-	must(err)
-	defer stmt.Finalize()
-	must(stmt.Exec(url))
-	if stmt.Next() {
-		r.IsNew = false
-		must(stmt.Scan(&r.Id, &r.IsImportant, &r.LastVisit))
-
-		if r.IsImportant {
-			// Don't have to update last visit or to change the value for the important field
-			return
-		}
+// Records that u was given as input, so that it's listed even if it's also a subpage of another url
+func (u *Url) SetBookmarked() {
+	archive.SetBookmarked(u)
+}
 
-		r.IsImportant = important
-		r.LastVisit = lastVisit
+func (u *Url) AddSubpage(sub Url) {
+	archive.AddSubpage(u, &sub)
+}
 
-		must(dbConn.Exec("update urls set important = ?, last_visit = ? where id = ?", r.IsImportant, r.LastVisit, r.Id))
-		return
-	} else {
-		if !recur {
-			fmt.Fprintf(os.Stderr, "Could not insert url %s in database\n", url)
-			os.Exit(1)
-		}
-		must(dbConn.Exec("insert into urls(url, important, last_visit) values (?, ?, ?)", url, important, lastVisit))
-		r := Lookup(url, important, lastVisit, false)
-		r.IsNew = true
-		return r
-	}
+func (u *Url) listSubpages() []Url {
+	return archive.ListSubpages(u)
 }
 
-func listUrls() []Url {
-	stmt, err := dbConn.Prepare("select id, url, important, last_visit, min(title) from urls, content2idx where urls.id = content2idx.url_id group by urls.id")
-	must(err)
-	defer stmt.Finalize()
-	must(stmt.Exec())
-	r := make([]Url, 0)
-	for stmt.Next() {
-		var url Url
-		must(stmt.Scan(&url.Id, &url.Url, &url.IsImportant, &url.LastVisit, &url.Title))
-		r = append(r, url)
-	}
-	return r
+func (u *Url) listUrlRevisions() []Revision {
+	return archive.ListRevisions(u)
 }
 
-func getUrl(id int) (r Url, ok bool) {
-	stmt, err := dbConn.Prepare("select url, important, last_visit from urls where id = ?")
-	must(err)
-	defer stmt.Finalize()
-	must(stmt.Exec(id))
-	if !stmt.Next() {
-		ok = false
-		return
-	}
-	r.Id = id
-	must(stmt.Scan(&r.Url, &r.IsImportant, &r.LastVisit))
-	ok = true
-	return
+// Returns the number of bytes used to store the revisions of u
+func (u *Url) StoredSize() int {
+	return archive.StoredSize(u)
 }
 
-func (u *Url) listUrlRevisions() (r []Revision) {
-	stmt, err := dbConn.Prepare("select retrieved, isgz, isdiff, content from content where url_id = ?")
-	must(err)
-	defer stmt.Finalize()
-	must(stmt.Exec(u.Id))
-	r = []Revision{}
-	for stmt.Next() {
-		var rev Revision
-		var content []byte
-		must(stmt.Scan(&rev.RetrievedDate, &rev.IsGz, &rev.IsDiff, &content))
-		rev.Size = len(content)
-		r = append(r, rev)
-	}
-	return
+// Returns the ids of all urls with stored content
+func listUrlIds() []int {
+	return archive.ListUrlIds()
 }
 
 func (u *Url) Remove() {
-	must(dbConn.Exec("delete from urls where id = ?", u.Id))
+	archive.RemoveUrl(u)
 }
 
+// Weight of matches in the title, and of matches of stems, relative to matches in the text when ranking search results
+const TITLE_WEIGHT = 10.0
+const STEMS_WEIGHT = 0.5
+
+// Markers around the matching terms of search snippets, control characters that are not expected in extracted text
+const SNIPPET_START = "\x02"
+const SNIPPET_END = "\x03"
+const SNIPPET_TOKENS = 24
+
 type Result struct {
-	UrlId string
-	Url   string
-	Title string
+	UrlId   string
+	Url     string
+	Title   string
+	Snippet string // matching terms are between SNIPPET_START and SNIPPET_END
+	Dates   []int  // retrieval dates of the matching revisions, newest first
 }
 
-func search(q string) []Result {
-	stmt, err := dbConn.Prepare("select url_id, title from content2idx where title match ? union select url_id, title from content2idx where ttext match ?")
-	must(err)
-	defer stmt.Finalize()
-	must(stmt.Exec(q, q))
-	r := []Result{}
-	for stmt.Next() {
-		var a Result
-		must(stmt.Scan(&a.UrlId, &a.Title))
-		r = append(r, a)
+func search(q string, offset, limit int) ([]Result, int, error) {
+	sq, err := parseQuery(q)
+	if err != nil {
+		return nil, 0, err
 	}
+	return archive.Search(sq, offset, limit)
+}
 
-	for i := range r {
-		id, _ := strconv.Atoi(r[i].UrlId)
-		u, ok := getUrl(id)
-		if ok {
-			r[i].Url = u.Url
+// Stores content in the content addressable storage and returns its id
+func StoreContentAddressable(url, contentType string, content []byte) string {
+	return archive.StoreResource(url, contentType, content)
+}
+
+// Records that the resource url referenced by pageUrl was not stored and why
+func RecordSkippedResource(pageUrl, url, reason string) {
+	archive.RecordSkippedResource(pageUrl, url, reason, int(time.Now().Unix()))
+}
+
+// Records that the resource url was retrieved now with contentId as its content
+func RecordResourceFetch(url, contentId string) {
+	archive.RecordResourceFetch(url, contentId, int(time.Now().Unix()))
+}
+
+// Returns the id of the content of resource url retrieved closest to date
+func ClosestResource(url string, date int) (contentId string, ok bool) {
+	return archive.ClosestResource(url, date)
+}
+
+// Lists the ids of all additional resources that still use SHA-1 ids
+func listLegacyContentAddressableIds() []string {
+	r := []string{}
+	for _, id := range archive.ListResourceIds() {
+		if isLegacyContentAddressableId(id) {
+			r = append(r, id)
 		}
-		//TODO
 	}
 	return r
 }
 
-func RetrieveContentAddressable(url string, dbAccessLock sync.Mutex) (string, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
+// Changes the id of an additional resource from oldId to newId
+func renameContentAddressable(oldId, newId string) {
+	archive.RenameResource(oldId, newId)
+}
 
-	contentType := resp.Header.Get("Content-Type")
-	content, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
+type SkippedResource struct {
+	Url           string
+	Reason        string
+	RetrievedDate int
+}
 
-	contentId := contentAddressableId(content)
+type PageMissingResources struct {
+	Id           int
+	Url          string
+	Missing      int
+	LastRetrieve int
+}
 
-	dbAccessLock.Lock()
-	defer dbAccessLock.Unlock()
-	must(dbConn.Exec("insert or ignore into additional(contentid, url, contenttype, content) values (?, ?, ?, ?)", contentId, url, contentType, content))
+// Lists the archived pages that had resources missing when they were captured
+func listPagesMissingResources() []PageMissingResources {
+	return archive.ListPagesMissingResources()
+}
 
-	return contentId, nil
+func (u *Url) listSkippedResources() []SkippedResource {
+	return archive.ListSkippedResources(u.Url)
 }
 
 func GetContentAddressable(name string) (contentType string, content []byte, ok bool) {
-	stmt, err := dbConn.Prepare("select contenttype, content from additional where contentid = ?")
-	must(err)
-	defer stmt.Finalize()
-	stmt.Exec(name)
-	if !stmt.Next() {
-		return "", nil, false
+	contentType, content, codec, ok := GetContentAddressableRaw(name)
+	if ok {
+		content, ok = decompressResource(name, content, codec)
 	}
-
-	ok = true
-	must(stmt.Scan(&contentType, &content))
-	v := make([]byte, len(content))
-	copy(v, content)
-	content = v
 	return
 }
 
+// Decompresses the content of the additional resource name, not ok if it's corrupt
+func decompressResource(name string, content []byte, codec string) (r []byte, ok bool) {
+	if err := tryCatch(func() { r = decompress(content, codec) }); err != nil {
+		fmt.Fprintf(os.Stderr, "Can not decompress resource %s: %v\n", name, err)
+		return nil, false
+	}
+	return r, true
+}
+
+// Like GetContentAddressable but returns the content as stored, compressed with codec
+func GetContentAddressableRaw(name string) (contentType string, content []byte, codec string, ok bool) {
+	return archive.GetResource(name)
+}
+
+// Content types of additional resources that are worth compressing
+var COMPRESSIBLE_TYPES = []string{
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+	"image/x-icon",
+	"image/vnd.microsoft.icon",
+}
+
+func compressibleType(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mt, "text/") {
+		return true
+	}
+	for _, t := range COMPRESSIBLE_TYPES {
+		if mt == t {
+			return true
+		}
+	}
+	return false
+}
+
 var HEX_DIGITS = []byte{'0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'a', 'b', 'c', 'd', 'e', 'f'}
 
-func contentAddressableId(content []byte) string {
-	b := sha1.Sum(content)
+// Prefix of SHA-256 content ids, ids without a prefix are SHA-1 ids from older versions
+const SHA256_PREFIX = "sha256-"
+
+func hexString(b []byte) string {
 	r := make([]byte, len(b)*2)
 
 	for i := range b {
@@ -421,3 +379,25 @@ func contentAddressableId(content []byte) string {
 	}
 	return string(r)
 }
+
+func contentAddressableId(content []byte) string {
+	b := sha256.Sum256(content)
+	return SHA256_PREFIX + hexString(b[:])
+}
+
+func legacyContentAddressableId(content []byte) string {
+	b := sha1.Sum(content)
+	return hexString(b[:])
+}
+
+func isLegacyContentAddressableId(id string) bool {
+	return !strings.HasPrefix(id, SHA256_PREFIX)
+}
+
+// Checks that content matches its content addressable id
+func verifyContentAddressableId(id string, content []byte) bool {
+	if isLegacyContentAddressableId(id) {
+		return legacyContentAddressableId(content) == id
+	}
+	return contentAddressableId(content) == id
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"mime"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const additionalPrefix = "/additional/"
+
+// Returns the content of u at atDate as a single self-contained HTML file, all references to additional resources are inlined as data: URIs
+func (u *Url) ExportPage(atDate int) ([]byte, bool) {
+	content, _, ok := u.GetContent(atDate)
+	if !ok {
+		return nil, false
+	}
+
+	root, err := html.Parse(bytes.NewReader(content))
+	if err != nil {
+		return content, true
+	}
+
+	inlineAdditionalRecur(root)
+
+	// relative links would otherwise point to wherever the file ends up
+	if head := findChild(findRoot(root), "head"); head != nil && findChild(head, "base") == nil {
+		base := &html.Node{Type: html.ElementNode, Data: "base", DataAtom: atom.Base, Attr: []html.Attribute{{Key: "href", Val: u.Url}}}
+		head.InsertBefore(base, head.FirstChild)
+	}
+
+	var buf bytes.Buffer
+	if err := html.Render(&buf, root); err != nil {
+		return content, true
+	}
+	return buf.Bytes(), true
+}
+
+func inlineAdditionalRecur(node *html.Node) {
+	for n := node; n != nil; n = n.NextSibling {
+		if n.Type == html.ElementNode {
+			for i := range n.Attr {
+				if strings.HasPrefix(n.Attr[i].Val, additionalPrefix) {
+					n.Attr[i].Val = additionalDataUri(n.Attr[i].Val[len(additionalPrefix):], n.Attr[i].Val)
+				}
+			}
+		}
+		if n.FirstChild != nil {
+			inlineAdditionalRecur(n.FirstChild)
+		}
+	}
+}
+
+// Returns a data: URI for the additional resource name, or dflt if it isn't stored
+func additionalDataUri(name, dflt string) string {
+	contentType, content, ok := GetContentAddressable(name)
+	if !ok {
+		return dflt
+	}
+	if mt, params, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = strings.Replace(mime.FormatMediaType(mt, params), "; ", ";", -1)
+	} else {
+		contentType = "application/octet-stream"
+	}
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(content)
+}
+
+// Parses a date given on the command line either as a unix timestamp or as YYYY-MM-DD, the latter is interpreted as the end of that day
+func parseDate(s string) (int, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return n, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return 0, fmt.Errorf("bad date %q, use a unix timestamp or YYYY-MM-DD", s)
+	}
+	return int(t.AddDate(0, 0, 1).Unix()) - 1, nil
+}
+
+func exportPageCmd(args []string) {
+	var at string
+	fs := newSubcommandFlags("export-page")
+	fs.StringVar(&at, "at", "", "Exports the revision current at this date (unix timestamp or YYYY-MM-DD)")
+	args = parseSubcommandArgs(fs, args)
+	if len(args) != 1 {
+		usage()
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		usage()
+	}
+
+	atDate := -1
+	if at != "" {
+		atDate, err = parseDate(at)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	u, ok := getUrl(id)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "No url with id %d\n", id)
+		os.Exit(1)
+	}
+
+	content, ok := u.ExportPage(atDate)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "No content stored for %s\n", u.Url)
+		os.Exit(1)
+	}
+	os.Stdout.Write(content)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	FACET_DOMAIN     = "domain"
+	FACET_YEAR       = "year"
+	FACET_MONTH      = "month"
+	FACET_IMPORTANCE = "important"
+	FACET_TAG        = "tag"
+	FACET_TYPE       = "type"
+)
+
+// Maximum number of values shown for each facet
+const FACET_VALUES = 10
+
+type FacetValue struct {
+	Value  string `json:"value"`
+	Count  int    `json:"count"`
+	Filter string `json:"filter"` // added to the query restricts it to this value
+}
+
+type Facet struct {
+	Name   string       `json:"name"`
+	Values []FacetValue `json:"values"`
+}
+
+// Returns the facets of the results of the search q, values are sorted by count except for dates which are sorted newest first
+func searchFacets(q string) ([]Facet, error) {
+	sq, err := parseQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	facets, err := archive.Facets(sq)
+	if err != nil {
+		return nil, err
+	}
+	for i := range facets {
+		v := facets[i].Values
+		if facets[i].Name == FACET_YEAR || facets[i].Name == FACET_MONTH {
+			sort.Slice(v, func(a, b int) bool { return v[a].Value > v[b].Value })
+		} else {
+			sort.Slice(v, func(a, b int) bool {
+				if v[a].Count != v[b].Count {
+					return v[a].Count > v[b].Count
+				}
+				return v[a].Value < v[b].Value
+			})
+		}
+		if len(v) > FACET_VALUES {
+			v = v[:FACET_VALUES]
+		}
+		for j := range v {
+			v[j].Filter = facetFilter(facets[i].Name, v[j].Value)
+		}
+		facets[i].Values = v
+	}
+	return facets, nil
+}
+
+func filterValue(s string) string {
+	if strings.ContainsAny(s, " \t\"") {
+		return `"` + strings.Replace(s, `"`, "", -1) + `"`
+	}
+	return s
+}
+
+// Returns the filters to add to a query to restrict it to value of the facet name
+func facetFilter(name, value string) string {
+	switch name {
+	case FACET_DOMAIN:
+		return "site:" + filterValue(value)
+	case FACET_YEAR, FACET_MONTH:
+		layout, months := "2006", 12
+		if name == FACET_MONTH {
+			layout, months = "2006-01", 1
+		}
+		start, err := time.ParseInLocation(layout, value, time.Local)
+		if err != nil {
+			return ""
+		}
+		// after: excludes the day it is given, before: includes it
+		return "after:" + start.AddDate(0, 0, -1).Format("2006-01-02") + " before:" + start.AddDate(0, months, -1).Format("2006-01-02")
+	case FACET_IMPORTANCE:
+		return "important:" + value
+	case FACET_TAG:
+		return "tag:" + filterValue(value)
+	case FACET_TYPE:
+		return "type:" + filterValue(value)
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+)
+
+type fsckProblem struct {
+	UrlId         int
+	Url           string
+	RetrievedDate int
+	Descr         string
+}
+
+var additionalRefRe = regexp.MustCompile(additionalPrefix + `([A-Za-z0-9-]+)`)
+
+// Replays the chain of revisions of u, checking each reconstructed revision against its hash and that the additional resources it references exist
+func (u *Url) fsck(resources map[string]bool) []fsckProblem {
+	problems := []fsckProblem{}
+	report := func(retrieved int, descr string, args ...interface{}) {
+		problems = append(problems, fsckProblem{u.Id, u.Url, retrieved, fmt.Sprintf(descr, args...)})
+	}
+
+	var chain revisionChain
+	broken := false
+	missing := map[string]bool{}
+	for _, sr := range archive.StoredRevisions(u) {
+		content, err := chain.next(sr)
+		if err != nil {
+			// the diffs following a broken revision are only reported once
+			if !broken || !sr.IsDiff {
+				report(sr.RetrievedDate, "can not reconstruct revision: %v", err)
+			}
+			broken = true
+			continue
+		}
+
+		broken = false
+		if err := checkRevisionHash(sr, content); err != nil {
+			report(sr.RetrievedDate, "%v", err)
+		}
+		for _, m := range additionalRefRe.FindAllSubmatch(content, -1) {
+			id := string(m[1])
+			if !resources[id] && !missing[id] {
+				missing[id] = true
+				report(sr.RetrievedDate, "references missing resource %s", id)
+			}
+		}
+	}
+
+	return problems
+}
+
+func fsckResources() []fsckProblem {
+	problems := []fsckProblem{}
+	for _, contentId := range archive.ListResourceIds() {
+		_, content, ok := GetContentAddressable(contentId)
+		switch {
+		case !ok:
+			problems = append(problems, fsckProblem{Descr: fmt.Sprintf("resource %s can not be read", contentId)})
+		case !verifyContentAddressableId(contentId, content):
+			problems = append(problems, fsckProblem{Descr: fmt.Sprintf("resource %s does not match its id", contentId)})
+		}
+	}
+	return problems
+}
+
+// Checks the integrity of the archive, reports every problem found and exits with a non-zero status if there are any
+func fsckCmd() {
+	m := archiveMaintenance()
+	problems := []fsckProblem{}
+	resources := map[string]bool{}
+	for _, id := range archive.ListResourceIds() {
+		resources[id] = true
+	}
+	urls := 0
+	for _, id := range listUrlIds() {
+		u, ok := getUrl(id)
+		if !ok {
+			u = Url{Id: id}
+		}
+		problems = append(problems, u.fsck(resources)...)
+		urls++
+	}
+	problems = append(problems, fsckResources()...)
+	problems = append(problems, m.CheckIndex()...)
+
+	for _, p := range problems {
+		switch {
+		case p.RetrievedDate != 0:
+			fmt.Printf("%d\t%s\trevision %d: %s\n", p.UrlId, p.Url, p.RetrievedDate, p.Descr)
+		case p.UrlId != 0:
+			fmt.Printf("%d\t%s\t%s\n", p.UrlId, p.Url, p.Descr)
+		default:
+			fmt.Printf("\t%s\t%s\n", p.Url, p.Descr)
+		}
+	}
+
+	fmt.Printf("Checked %d urls, %d problems found\n", urls, len(problems))
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
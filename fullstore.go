@@ -5,6 +5,10 @@ import (
 	"fmt"
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
@@ -13,6 +17,22 @@ import (
 
 const dldParallelism = 20
 
+// Resources larger than MAX_RESOURCE_SIZE are never stored, once the resources of a page add up to MAX_PAGE_RESOURCES_SIZE the remaining ones are skipped
+const MAX_RESOURCE_SIZE = 2 * 1024 * 1024
+const MAX_PAGE_RESOURCES_SIZE = 10 * 1024 * 1024
+
+// Content types of the resources that fullStore will store
+var ALLOWED_RESOURCE_TYPES = []string{
+	"text/css",
+	"image/gif",
+	"image/jpeg",
+	"image/png",
+	"image/svg+xml",
+	"image/webp",
+	"image/x-icon",
+	"image/vnd.microsoft.icon",
+}
+
 type urlToFetch struct {
 	resUrl string
 	attrs  []*string
@@ -20,23 +40,54 @@ type urlToFetch struct {
 
 type urlsToFetch map[string]*urlToFetch
 
-func fullStore(url string, node *html.Node) {
+type fetchedResource struct {
+	url, contentType string
+	content          []byte
+	contentId        string
+}
+
+type skippedResource struct {
+	url, reason string
+}
+
+// State shared by all the downloads of a single page, resources are kept in memory until store is called
+type pageFetch struct {
+	pageUrl   string
+	lock      sync.Mutex
+	used      int // bytes of resources downloaded so far, the fields below are also protected by lock
+	resources []fetchedResource
+	skipped   []skippedResource
+}
+
+// Downloads the resources referenced by node and points the references to the content ids they will have once stored, nothing is written to the database
+func fullStore(url string, node *html.Node) *pageFetch {
 	toFetch := make(urlsToFetch)
 	fullStoreSiblingRecur(url, node, toFetch)
 	gate := syncutil.NewGate(dldParallelism)
-	var dbAccessLock sync.Mutex
+	pf := &pageFetch{pageUrl: url}
 	for k := range toFetch {
 		gate.Start()
 		f := toFetch[k]
 		go func() {
 			defer gate.Done()
-			f.Fetch(dbAccessLock)
+			f.Fetch(pf)
 		}()
 	}
 	for i := 0; i < dldParallelism; i++ {
 		gate.Start()
 	}
-	return
+	return pf
+}
+
+// Stores the resources downloaded for the page and records the ones that were skipped
+func (pf *pageFetch) store() {
+	for _, res := range pf.resources {
+		StoreContentAddressable(res.url, res.contentType, res.content)
+		RecordResourceFetch(res.url, res.contentId)
+	}
+	for _, sk := range pf.skipped {
+		RecordSkippedResource(pf.pageUrl, sk.url, sk.reason)
+	}
 }
 
 func fullStoreSiblingRecur(url string, node *html.Node, toFetch urlsToFetch) {
@@ -113,14 +164,89 @@ func (toFetch urlsToFetch) Add(resUrl string, val *string) {
 	m.attrs = append(m.attrs, val)
 }
 
-func (u *urlToFetch) Fetch(dbAccessLock sync.Mutex) {
-	caddr, err := RetrieveContentAddressable(u.resUrl, dbAccessLock)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "\tError retrieving resource %s: %v\n", u.resUrl, err)
+func (u *urlToFetch) Fetch(pf *pageFetch) {
+	contentType, content, reason := pf.download(u.resUrl)
+
+	pf.lock.Lock()
+	defer pf.lock.Unlock()
+
+	if reason == "" && pf.used+len(content) > MAX_PAGE_RESOURCES_SIZE {
+		reason = fmt.Sprintf("page resources budget of %d bytes exhausted", MAX_PAGE_RESOURCES_SIZE)
+	}
+	if reason != "" {
+		fmt.Fprintf(os.Stderr, "\tSkipped resource %s: %s\n", u.resUrl, reason)
+		pf.skipped = append(pf.skipped, skippedResource{u.resUrl, reason})
 		return
 	}
+	pf.used += len(content)
+
+	caddr := contentAddressableId(content)
+	pf.resources = append(pf.resources, fetchedResource{u.resUrl, contentType, content, caddr})
 
 	for i := range u.attrs {
 		*(u.attrs[i]) = "/additional/" + caddr
 	}
 }
+
+// Downloads resUrl, if the resource can not be stored reason will explain why
+func (pf *pageFetch) download(resUrl string) (contentType string, content []byte, reason string) {
+	pf.lock.Lock()
+	exhausted := pf.used >= MAX_PAGE_RESOURCES_SIZE
+	pf.lock.Unlock()
+	if exhausted {
+		return "", nil, fmt.Sprintf("page resources budget of %d bytes exhausted", MAX_PAGE_RESOURCES_SIZE)
+	}
+
+	resp, err := http.Get(resUrl)
+	if err != nil {
+		return "", nil, fmt.Sprintf("error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", nil, fmt.Sprintf("status code %d", resp.StatusCode)
+	}
+
+	contentType = resp.Header.Get("Content-Type")
+	if !allowedResourceType(contentType) {
+		return "", nil, fmt.Sprintf("content type %q not allowed", contentType)
+	}
+
+	if resp.ContentLength > MAX_RESOURCE_SIZE {
+		return "", nil, fmt.Sprintf("size %d larger than %d bytes", resp.ContentLength, MAX_RESOURCE_SIZE)
+	}
+
+	content, err = ioutil.ReadAll(io.LimitReader(resp.Body, MAX_RESOURCE_SIZE+1))
+	if err != nil {
+		return "", nil, fmt.Sprintf("error: %v", err)
+	}
+	if len(content) > MAX_RESOURCE_SIZE {
+		return "", nil, fmt.Sprintf("larger than %d bytes", MAX_RESOURCE_SIZE)
+	}
+
+	return contentType, content, ""
+}
+
+func allowedResourceType(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range ALLOWED_RESOURCE_TYPES {
+		if mt == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Prints the pages that had resources missing when they were captured
+func missingResourcesCmd() {
+	for _, p := range listPagesMissingResources() {
+		fmt.Printf("%d\t%d\t%s\n", p.Id, p.Missing, p.Url)
+		u := Url{Id: p.Id, Url: p.Url}
+		for _, sr := range u.listSkippedResources() {
+			fmt.Printf("\t%d\t%s\t%s\n", sr.RetrievedDate, sr.Url, sr.Reason)
+		}
+	}
+}
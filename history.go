@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+)
+
+// The revisions of a url in which a phrase was found, dates are 0 when there is no such revision
+type PhraseHistory struct {
+	Phrase    string
+	Revisions int    // revisions searched
+	Matches   int    // revisions containing the phrase
+	First     int    // first revision containing the phrase
+	Before    int    // revision before First, the phrase appeared after it
+	Last      int    // last revision containing the phrase
+	After     int    // revision after Last, the phrase vanished in it
+	Err       string // why some revisions could not be searched
+}
+
+// Reduces text to its folded words separated by single spaces, padded with a space on both sides so that phrases only match whole words
+func phraseText(text string) string {
+	return " " + strings.Join(words(foldText(text)), " ") + " "
+}
+
+// Searches phrase in the text extracted from every revision of u, ignoring case, accents, punctuation and spacing
+func (u *Url) PhraseHistory(phrase string) PhraseHistory {
+	h := PhraseHistory{Phrase: phrase}
+	p := phraseText(phrase)
+	if strings.TrimSpace(p) == "" {
+		return h
+	}
+	revs, err := u.AllRevisions()
+	if err != nil {
+		// the revisions before the broken one are still searched
+		h.Err = err.Error()
+	}
+	prev := 0
+	for _, rev := range revs {
+		h.Revisions++
+		title, text := extractText(u.Url, rev.Content)
+		if strings.Contains(phraseText(title+" "+text), p) {
+			h.Matches++
+			if h.First == 0 {
+				h.First, h.Before = rev.RetrievedDate, prev
+			}
+			h.Last, h.After = rev.RetrievedDate, 0
+		} else if h.Last != 0 && h.After == 0 {
+			h.After = rev.RetrievedDate
+		}
+		prev = rev.RetrievedDate
+	}
+	return h
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Languages with a stemmer, pages in other languages are indexed without stems
+const (
+	LANG_ENGLISH = "en"
+	LANG_ITALIAN = "it"
+	LANG_GERMAN  = "de"
+)
+
+var LANGUAGES = []string{LANG_ENGLISH, LANG_ITALIAN, LANG_GERMAN}
+
+// Minimum number of stop words found in a text to guess its language
+const MIN_LANGUAGE_HITS = 3
+
+var stopWords = map[string][]string{
+	LANG_ENGLISH: {"the", "and", "of", "to", "is", "in", "that", "for", "with", "this", "are", "on", "was", "be", "it", "as", "not", "you", "have", "from"},
+	LANG_ITALIAN: {"il", "di", "che", "la", "per", "un", "una", "non", "sono", "del", "della", "con", "gli", "le", "nel", "anche", "come", "questo", "alla", "dei"},
+	LANG_GERMAN:  {"der", "die", "und", "das", "ist", "nicht", "ein", "eine", "zu", "mit", "den", "von", "auf", "für", "sich", "auch", "dem", "des", "im", "werden"},
+}
+
+// Suffixes removed by the stemmer of each language, sorted longest first by init
+var stemSuffixes = map[string][]string{
+	LANG_ENGLISH: {"ational", "ization", "fulness", "iveness", "ations", "nesses", "ation", "ments", "ness", "ment", "ings", "ing", "ies", "ied", "ers", "ed", "er", "es", "ly", "s"},
+	LANG_ITALIAN: {"azioni", "azione", "amento", "amenti", "imento", "imenti", "atrice", "atrici", "mente", "abile", "abili", "ibile", "ibili", "avano", "evano", "ivano", "ando", "endo", "ista", "iste", "isti", "ismo", "ismi", "anza", "anze", "enza", "enze", "ita", "ivo", "iva", "ivi", "ive", "oso", "osa", "osi", "ose", "are", "ere", "ire", "ato", "ata", "ati", "ate", "uto", "uta", "uti", "ute", "ito", "iti", "ite", "ava", "eva", "o", "a", "i", "e"},
+	LANG_GERMAN:  {"ungen", "heiten", "keiten", "ung", "heit", "keit", "lich", "isch", "ern", "em", "en", "er", "es", "e", "s", "n"},
+}
+
+func init() {
+	for _, suffixes := range stemSuffixes {
+		sort.SliceStable(suffixes, func(i, j int) bool { return len(suffixes[i]) > len(suffixes[j]) })
+	}
+}
+
+// Minimum length, in runes, of what's left of a word after removing a suffix
+const MIN_STEM_LENGTH = 3
+
+// Lowercases s and removes its diacritics, ß becomes ss
+func foldText(s string) string {
+	s = strings.Replace(strings.ToLower(s), "ß", "ss", -1)
+	r, _, err := transform.String(transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), s)
+	if err != nil {
+		return s
+	}
+	return r
+}
+
+func words(s string) []string {
+	return strings.FieldsFunc(s, func(ch rune) bool { return !unicode.IsLetter(ch) && !unicode.IsDigit(ch) })
+}
+
+// Guesses the language of text counting its stop words, returns the empty string if no language is recognized
+func detectLanguage(text string) string {
+	sets := map[string]map[string]bool{}
+	for lang, sw := range stopWords {
+		sets[lang] = map[string]bool{}
+		for _, w := range sw {
+			sets[lang][w] = true
+		}
+	}
+	hits := map[string]int{}
+	for _, w := range words(strings.ToLower(text)) {
+		for lang := range sets {
+			if sets[lang][w] {
+				hits[lang]++
+			}
+		}
+	}
+	best := ""
+	for _, lang := range LANGUAGES {
+		if hits[lang] >= MIN_LANGUAGE_HITS && (best == "" || hits[lang] > hits[best]) {
+			best = lang
+		}
+	}
+	return best
+}
+
+// Stems a folded word removing the longest suffix of lang that leaves at least MIN_STEM_LENGTH runes
+func stemWord(lang, w string) string {
+	n := len([]rune(w))
+	for _, suffix := range stemSuffixes[lang] {
+		if strings.HasSuffix(w, suffix) && n-len([]rune(suffix)) >= MIN_STEM_LENGTH {
+			return w[:len(w)-len(suffix)]
+		}
+	}
+	return w
+}
+
+// Returns the stems of all the words of text, separated by spaces, empty if lang has no stemmer
+func stemText(lang, text string) string {
+	if _, ok := stemSuffixes[lang]; !ok {
+		return ""
+	}
+	ws := words(foldText(text))
+	for i := range ws {
+		ws[i] = stemWord(lang, ws[i])
+	}
+	return strings.Join(ws, " ")
+}
+
+// Returns the stems of a query word in every language with a stemmer, since the language of the pages searched is not known
+func queryStems(w string) []string {
+	w = foldText(w)
+	seen := map[string]bool{}
+	r := []string{}
+	for _, lang := range LANGUAGES {
+		s := stemWord(lang, w)
+		if !seen[s] {
+			seen[s] = true
+			r = append(r, s)
+		}
+	}
+	return r
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"net/url"
+	"strings"
+)
+
+const archivedLinkClass = "urlarchive-archived"
+const liveLinkClass = "urlarchive-live"
+
+const linkMarkerStyle = `
+a.urlarchive-archived { border-bottom: 2px solid #2a2; }
+a.urlarchive-live { border-bottom: 2px dotted #c22; }
+`
+
+// Rewrites the anchors of an archived page so that links to pages that are also in the archive point to the archived copy, all other links are made absolute so that they point to the live web.
+// Images and stylesheets that weren't stored with the page are replaced with the copy retrieved closest to retrievedDate, if there is one.
+func rewriteLinks(pageUrl string, retrievedDate int, content []byte) []byte {
+	root, err := html.Parse(bytes.NewReader(content))
+	if err != nil {
+		return content
+	}
+
+	baseUrl := pageUrl
+	head := findChild(findRoot(root), "head")
+	if base := findChild(head, "base"); base != nil {
+		for _, attr := range base.Attr {
+			if strings.ToLower(attr.Key) == "href" {
+				baseUrl = resolveUrl(pageUrl, attr.Val)
+			}
+		}
+	}
+
+	rewriteLinksRecur(baseUrl, root)
+
+	resources := make(urlsToFetch)
+	fullStoreSiblingRecur(baseUrl, root, resources)
+	for resUrl, res := range resources {
+		contentId, ok := ClosestResource(resUrl, retrievedDate)
+		if !ok {
+			continue
+		}
+		for _, attr := range res.attrs {
+			if !strings.HasPrefix(*attr, additionalPrefix) {
+				*attr = additionalPrefix + contentId
+			}
+		}
+	}
+
+	if head != nil {
+		style := &html.Node{Type: html.ElementNode, Data: "style", DataAtom: atom.Style}
+		style.AppendChild(&html.Node{Type: html.TextNode, Data: linkMarkerStyle})
+		head.AppendChild(style)
+	}
+
+	var buf bytes.Buffer
+	if err := html.Render(&buf, root); err != nil {
+		return content
+	}
+	return buf.Bytes()
+}
+
+func rewriteLinksRecur(baseUrl string, node *html.Node) {
+	for n := node; n != nil; n = n.NextSibling {
+		if n.Type == html.ElementNode && n.DataAtom == atom.A {
+			rewriteLink(baseUrl, n)
+		}
+		if n.FirstChild != nil {
+			rewriteLinksRecur(baseUrl, n.FirstChild)
+		}
+	}
+}
+
+func rewriteLink(baseUrl string, node *html.Node) {
+	hrefIdx := -1
+	for i := range node.Attr {
+		if strings.ToLower(node.Attr[i].Key) == "href" {
+			hrefIdx = i
+		}
+	}
+	if hrefIdx < 0 {
+		return
+	}
+
+	href := strings.TrimSpace(node.Attr[hrefIdx].Val)
+	if href == "" || href[0] == '#' {
+		return
+	}
+
+	u, err := url.Parse(resolveUrl(baseUrl, href))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return
+	}
+
+	fragment := u.Fragment
+	u.Fragment = ""
+
+	class := liveLinkClass
+	if id, ok := findUrlId(u.String()); ok {
+		class = archivedLinkClass
+		node.Attr[hrefIdx].Val = fmt.Sprintf("/url?id=%d", id)
+		if fragment != "" {
+			node.Attr[hrefIdx].Val += "#" + fragment
+		}
+	} else {
+		u.Fragment = fragment
+		node.Attr[hrefIdx].Val = u.String()
+	}
+
+	addClass(node, class)
+}
+
+func addClass(node *html.Node, class string) {
+	for i := range node.Attr {
+		if strings.ToLower(node.Attr[i].Key) == "class" {
+			node.Attr[i].Val = strings.TrimSpace(node.Attr[i].Val + " " + class)
+			return
+		}
+	}
+	node.Attr = append(node.Attr, html.Attribute{Key: "class", Val: class})
+}
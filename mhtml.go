@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/net/html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const mhtmlCidDomain = "@urlarchive"
+
+// Returns the content of u at atDate, together with all its additional resources, as a MHTML (multipart/related) document
+func (u *Url) ExportMHTML(atDate int) ([]byte, bool) {
+	content, _, ok := u.GetContent(atDate)
+	if !ok {
+		return nil, false
+	}
+
+	names := []string{}
+	if root, err := html.Parse(bytes.NewReader(content)); err == nil {
+		seen := map[string]bool{}
+		mhtmlCidRecur(root, seen, &names)
+		var buf bytes.Buffer
+		if err := html.Render(&buf, root); err == nil {
+			content = buf.Bytes()
+		}
+	}
+
+	title, _, _, _ := u.GetContent2()
+
+	var out bytes.Buffer
+	mw := multipart.NewWriter(&out)
+
+	fmt.Fprintf(&out, "From: <Saved by urlarchive>\r\n")
+	fmt.Fprintf(&out, "Snapshot-Content-Location: %s\r\n", u.Url)
+	fmt.Fprintf(&out, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", title))
+	fmt.Fprintf(&out, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&out, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&out, "Content-Type: multipart/related; type=\"text/html\"; boundary=\"%s\"\r\n\r\n", mw.Boundary())
+
+	hdr := textproto.MIMEHeader{}
+	hdr.Set("Content-Type", "text/html")
+	hdr.Set("Content-Transfer-Encoding", "quoted-printable")
+	hdr.Set("Content-Location", u.Url)
+	pw, err := mw.CreatePart(hdr)
+	must(err)
+	qw := quotedprintable.NewWriter(pw)
+	qw.Write(content)
+	qw.Close()
+
+	for _, name := range names {
+		contentType, resContent, ok := GetContentAddressable(name)
+		if !ok {
+			continue
+		}
+		hdr := textproto.MIMEHeader{}
+		hdr.Set("Content-Type", contentType)
+		hdr.Set("Content-Transfer-Encoding", "base64")
+		hdr.Set("Content-ID", "<"+name+mhtmlCidDomain+">")
+		pw, err := mw.CreatePart(hdr)
+		must(err)
+		writeBase64Lines(pw, resContent)
+	}
+
+	mw.Close()
+	return out.Bytes(), true
+}
+
+// Replaces references to additional resources with cid: URLs, collecting the names of the resources
+func mhtmlCidRecur(node *html.Node, seen map[string]bool, names *[]string) {
+	for n := node; n != nil; n = n.NextSibling {
+		if n.Type == html.ElementNode {
+			for i := range n.Attr {
+				if !strings.HasPrefix(n.Attr[i].Val, additionalPrefix) {
+					continue
+				}
+				name := n.Attr[i].Val[len(additionalPrefix):]
+				if !seen[name] {
+					seen[name] = true
+					*names = append(*names, name)
+				}
+				n.Attr[i].Val = "cid:" + name + mhtmlCidDomain
+			}
+		}
+		if n.FirstChild != nil {
+			mhtmlCidRecur(n.FirstChild, seen, names)
+		}
+	}
+}
+
+func writeBase64Lines(w io.Writer, content []byte) {
+	const lineLength = 76
+	enc := base64.StdEncoding.EncodeToString(content)
+	for len(enc) > lineLength {
+		io.WriteString(w, enc[:lineLength]+"\r\n")
+		enc = enc[lineLength:]
+	}
+	io.WriteString(w, enc+"\r\n")
+}
+
+type mhtmlPart struct {
+	contentType string
+	location    string
+	cid         string
+	content     []byte
+}
+
+// Imports a MHTML document into the archive, the HTML part is stored as a new revision of its url and all the other parts are stored as additional resources
+func ImportMHTML(in io.Reader) (Url, error) {
+	msg, err := mail.ReadMessage(bufio.NewReader(in))
+	if err != nil {
+		return Url{}, err
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return Url{}, err
+	}
+	if mediaType != "multipart/related" {
+		return Url{}, fmt.Errorf("not a MHTML document, content type is %s", mediaType)
+	}
+
+	parts := []mhtmlPart{}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Url{}, err
+		}
+
+		var r io.Reader = p
+		if strings.ToLower(p.Header.Get("Content-Transfer-Encoding")) == "base64" {
+			r = base64.NewDecoder(base64.StdEncoding, p)
+		}
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			return Url{}, err
+		}
+
+		parts = append(parts, mhtmlPart{
+			contentType: p.Header.Get("Content-Type"),
+			location:    p.Header.Get("Content-Location"),
+			cid:         strings.Trim(p.Header.Get("Content-ID"), "<>"),
+			content:     content,
+		})
+	}
+
+	rootIdx := -1
+	for i := range parts {
+		if start := strings.Trim(params["start"], "<>"); start != "" {
+			if parts[i].cid == start {
+				rootIdx = i
+				break
+			}
+		} else if strings.HasPrefix(parts[i].contentType, "text/html") {
+			rootIdx = i
+			break
+		}
+	}
+	if rootIdx < 0 {
+		return Url{}, fmt.Errorf("no HTML part")
+	}
+
+	pageUrl := parts[rootIdx].location
+	if pageUrl == "" {
+		pageUrl = msg.Header.Get("Snapshot-Content-Location")
+	}
+	if pageUrl == "" {
+		return Url{}, fmt.Errorf("could not determine the url of the document")
+	}
+
+	stored := map[string]string{}
+	for i := range parts {
+		if i == rootIdx {
+			continue
+		}
+		location := parts[i].location
+		if location == "" {
+			location = "cid:" + parts[i].cid
+		}
+		caddr := StoreContentAddressable(location, parts[i].contentType, parts[i].content)
+		if parts[i].cid != "" {
+			stored["cid:"+parts[i].cid] = caddr
+		}
+		if parts[i].location != "" {
+			stored[resolveUrl(pageUrl, parts[i].location)] = caddr
+		}
+	}
+
+	root, err := html.Parse(bytes.NewReader(parts[rootIdx].content))
+	if err != nil {
+		return Url{}, err
+	}
+	mhtmlResolveRecur(pageUrl, root, stored)
+
+	var buf bytes.Buffer
+	if err := html.Render(&buf, root); err != nil {
+		return Url{}, err
+	}
+
+	title, text, err := htmlExtract(root)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error extracting text from %s: %v\n", pageUrl, err)
+	}
+
+	urlDescr := Lookup(pageUrl, false, int(time.Now().Unix()))
+	urlDescr.SetBookmarked()
+	retrieved, _ := urlDescr.StoreRevision(buf.Bytes())
+	urlDescr.StoreContent2(retrieved, title, text)
+	urlDescr.SetContentType(buf.Bytes())
+
+	return urlDescr, nil
+}
+
+// Replaces references to the parts of a MHTML document with references to the corresponding additional resources
+func mhtmlResolveRecur(pageUrl string, node *html.Node, stored map[string]string) {
+	for n := node; n != nil; n = n.NextSibling {
+		if n.Type == html.ElementNode {
+			for i := range n.Attr {
+				v := n.Attr[i].Val
+				if !strings.HasPrefix(v, "cid:") {
+					v = resolveUrl(pageUrl, v)
+				}
+				if caddr, ok := stored[v]; ok {
+					n.Attr[i].Val = additionalPrefix + caddr
+				}
+			}
+		}
+		if n.FirstChild != nil {
+			mhtmlResolveRecur(pageUrl, n.FirstChild, stored)
+		}
+	}
+}
+
+func exportMHTMLCmd(args []string) {
+	var at string
+	fs := newSubcommandFlags("export-mhtml")
+	fs.StringVar(&at, "at", "", "Exports the revision current at this date (unix timestamp or YYYY-MM-DD)")
+	args = parseSubcommandArgs(fs, args)
+	if len(args) != 1 {
+		usage()
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		usage()
+	}
+
+	atDate := -1
+	if at != "" {
+		atDate, err = parseDate(at)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	u, ok := getUrl(id)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "No url with id %d\n", id)
+		os.Exit(1)
+	}
+
+	content, ok := u.ExportMHTML(atDate)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "No content stored for %s\n", u.Url)
+		os.Exit(1)
+	}
+	os.Stdout.Write(content)
+}
+
+func importMHTMLCmd(args []string) {
+	if len(args) < 1 {
+		usage()
+	}
+	for _, path := range args {
+		fh, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			continue
+		}
+		u, err := ImportMHTML(fh)
+		fh.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error importing %s: %v\n", path, err)
+			continue
+		}
+		fmt.Printf("Imported %s as %d (%s)\n", path, u.Id, u.Url)
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+type migration struct {
+	version     int
+	description string
+	apply       func() error
+}
+
+// Schema migrations, in order. Each one is executed inside a transaction and must never be changed once released, schema changes go in a new migration at the end of the list.
+// Migrations must also work on databases created before schema versioning was introduced, where part of the schema may already exist.
+var migrations = []migration{
+	{1, "urls, content, additional resources and full text index", migrateBaseTables},
+	{2, "skipped resources", migrateSkippedResources},
+	{3, "resource history", migrateResourceHistory},
+	{4, "crawl configuration and subpages", migrateCrawl},
+	{5, "compressed additional resources", migrateAdditionalIsGz},
+	{6, "diff encoding of content", migrateContentEncoding},
+	{7, "compression codec instead of isgz", migrateCodec},
+	{8, "content hash of revisions", migrateContentHash},
+	{9, "blobs stored outside the database", migrateBlobRefs},
+	{10, "full text index on fts5", migrateFTS5},
+	{11, "full text index of every revision", migrateRevisionText},
+	{12, "tags and content type of urls", migrateTags},
+	{13, "language and stems of extracted text", migrateStems},
+	{14, "saved searches", migrateSavedSearches},
+}
+
+func execAll(stmts ...string) error {
+	for _, stmt := range stmts {
+		if err := dbConn.Exec(stmt); err != nil {
+			return fmt.Errorf("%v executing %q", err, stmt)
+		}
+	}
+	return nil
+}
+
+func migrateBaseTables() error {
+	err := execAll(`CREATE TABLE IF NOT EXISTS urls (
+		id integer primary key autoincrement not null,
+		url text not null,
+		important boolean not null,
+		last_visit date not null
+	)`,
+		`CREATE TABLE IF NOT EXISTS content (
+		url_id integer not null,
+		isdiff boolean not null,
+		isgz boolean not null,
+		retrieved date not null,
+		content blob not null
+	)`,
+		`CREATE TABLE IF NOT EXISTS additional (
+		contentid text primary key not null,
+		url text not null,
+		contenttype text not null,
+		content blob not null
+	)`)
+	if err != nil {
+		return err
+	}
+
+	if !hasTable("content2idx") {
+		return execAll(`CREATE VIRTUAL TABLE content2idx USING fts3(
+			url_id integer primary key autoincrement not null, 
+			title text,
+			ttext text
+		)`)
+	}
+	return nil
+}
+
+func migrateSkippedResources() error {
+	return execAll(`CREATE TABLE IF NOT EXISTS skipped_resources (
+		page_url text not null,
+		url text not null,
+		reason text not null,
+		retrieved date not null
+	)`)
+}
+
+func migrateResourceHistory() error {
+	return execAll(`CREATE TABLE IF NOT EXISTS resource_history (
+		url text not null,
+		fetched date not null,
+		contentid text not null
+	)`,
+		`CREATE INDEX IF NOT EXISTS resource_history_url ON resource_history (url, fetched)`)
+}
+
+func migrateCrawl() error {
+	err := execAll(`CREATE TABLE IF NOT EXISTS crawl_config (
+		url_id integer primary key not null,
+		depth integer not null,
+		max_pages integer not null
+	)`,
+		`CREATE TABLE IF NOT EXISTS subpages (
+		parent_id integer not null,
+		url_id integer not null,
+		primary key (parent_id, url_id)
+	)`)
+	if err != nil || hasColumn("urls", "bookmarked") {
+		return err
+	}
+	// urls that were never found crawling were given as input
+	return execAll(`ALTER TABLE urls ADD COLUMN bookmarked boolean not null default 0`,
+		`UPDATE urls SET bookmarked = 1 WHERE id NOT IN (SELECT url_id FROM subpages)`)
+}
+
+func migrateAdditionalIsGz() error {
+	if hasColumn("additional", "isgz") {
+		return nil
+	}
+	return execAll(`ALTER TABLE additional ADD COLUMN isgz boolean not null default 0`)
+}
+
+// Old versions made every diff from the last full revision
+func migrateContentEncoding() error {
+	return execAll(`ALTER TABLE content ADD COLUMN encoding text not null default 'bsdiff'`,
+		`UPDATE content SET encoding = 'bsdiff-base' WHERE isdiff = 1`)
+}
+
+func migrateCodec() error {
+	return execAll(`CREATE TABLE content_new (
+		url_id integer not null,
+		isdiff boolean not null,
+		codec text not null,
+		encoding text not null default 'bsdiff',
+		retrieved date not null,
+		content blob not null
+	)`,
+		`INSERT INTO content_new (url_id, isdiff, codec, encoding, retrieved, content)
+		SELECT url_id, isdiff, CASE WHEN isgz THEN 'gzip' ELSE 'none' END, encoding, retrieved, content FROM content`,
+		`DROP TABLE content`,
+		`ALTER TABLE content_new RENAME TO content`,
+		`CREATE INDEX content_url_id ON content (url_id, retrieved)`,
+		`CREATE TABLE additional_new (
+		contentid text primary key not null,
+		url text not null,
+		contenttype text not null,
+		codec text not null default 'none',
+		content blob not null
+	)`,
+		`INSERT INTO additional_new (contentid, url, contenttype, codec, content)
+		SELECT contentid, url, contenttype, CASE WHEN isgz THEN 'gzip' ELSE 'none' END, content FROM additional`,
+		`DROP TABLE additional`,
+		`ALTER TABLE additional_new RENAME TO additional`)
+}
+
+func migrateContentHash() error {
+	return execAll(`ALTER TABLE content ADD COLUMN hash text`)
+}
+
+func migrateBlobRefs() error {
+	return execAll(`ALTER TABLE content ADD COLUMN blob text`, `ALTER TABLE additional ADD COLUMN blob text`)
+}
+
+// The fts3 index could have more than one row per url, only the last one inserted is kept. The rowid of the new index is the url id.
+func migrateFTS5() error {
+	return execAll(`CREATE VIRTUAL TABLE content2idx_new USING fts5(url_id UNINDEXED, title, ttext)`,
+		`INSERT INTO content2idx_new (rowid, url_id, title, ttext)
+		SELECT url_id, url_id, title, ttext FROM content2idx WHERE rowid IN (SELECT max(rowid) FROM content2idx GROUP BY url_id)`,
+		`DROP TABLE content2idx`,
+		`ALTER TABLE content2idx_new RENAME TO content2idx`)
+}
+
+// Moves the extracted text to revision_text, indexed by content2idx as its external content. The text already indexed is assigned to the last revision of each url, older revisions are indexed by the reindex command.
+func migrateRevisionText() error {
+	return execAll(`CREATE TABLE revision_text (
+		id integer primary key,
+		url_id integer not null,
+		retrieved integer not null,
+		title text not null,
+		ttext text not null
+	)`,
+		`CREATE UNIQUE INDEX revision_text_url_id ON revision_text (url_id, retrieved)`,
+		`INSERT INTO revision_text (url_id, retrieved, title, ttext)
+		SELECT url_id, ifnull((SELECT max(retrieved) FROM content WHERE content.url_id = content2idx.url_id), 0), ifnull(title, ''), ifnull(ttext, '') FROM content2idx`,
+		`DROP TABLE content2idx`,
+		`CREATE VIRTUAL TABLE content2idx USING fts5(url_id UNINDEXED, retrieved UNINDEXED, title, ttext, content='revision_text', content_rowid='id')`,
+		`INSERT INTO content2idx (content2idx) VALUES ('rebuild')`,
+		`CREATE TRIGGER revision_text_ai AFTER INSERT ON revision_text BEGIN
+		INSERT INTO content2idx (rowid, url_id, retrieved, title, ttext) VALUES (new.id, new.url_id, new.retrieved, new.title, new.ttext);
+	END`,
+		`CREATE TRIGGER revision_text_ad AFTER DELETE ON revision_text BEGIN
+		INSERT INTO content2idx (content2idx, rowid, url_id, retrieved, title, ttext) VALUES ('delete', old.id, old.url_id, old.retrieved, old.title, old.ttext);
+	END`,
+		`CREATE TRIGGER revision_text_au AFTER UPDATE ON revision_text BEGIN
+		INSERT INTO content2idx (content2idx, rowid, url_id, retrieved, title, ttext) VALUES ('delete', old.id, old.url_id, old.retrieved, old.title, old.ttext);
+		INSERT INTO content2idx (rowid, url_id, retrieved, title, ttext) VALUES (new.id, new.url_id, new.retrieved, new.title, new.ttext);
+	END`)
+}
+
+func migrateTags() error {
+	return execAll(`CREATE TABLE tags (
+		url_id integer not null,
+		tag text not null,
+		primary key (url_id, tag)
+	)`,
+		`ALTER TABLE urls ADD COLUMN contenttype text not null default ''`)
+}
+
+// Diacritics are folded by the tokenizer of the new index, stems of the text already indexed are computed by the reindex command
+func migrateStems() error {
+	return execAll(`ALTER TABLE revision_text ADD COLUMN language text not null default ''`,
+		`ALTER TABLE revision_text ADD COLUMN stems text not null default ''`,
+		`DROP TRIGGER revision_text_ai`,
+		`DROP TRIGGER revision_text_ad`,
+		`DROP TRIGGER revision_text_au`,
+		`DROP TABLE content2idx`,
+		`CREATE VIRTUAL TABLE content2idx USING fts5(url_id UNINDEXED, retrieved UNINDEXED, title, ttext, stems, content='revision_text', content_rowid='id', tokenize='unicode61 remove_diacritics 2')`,
+		`INSERT INTO content2idx (content2idx) VALUES ('rebuild')`,
+		`CREATE TRIGGER revision_text_ai AFTER INSERT ON revision_text BEGIN
+		INSERT INTO content2idx (rowid, url_id, retrieved, title, ttext, stems) VALUES (new.id, new.url_id, new.retrieved, new.title, new.ttext, new.stems);
+	END`,
+		`CREATE TRIGGER revision_text_ad AFTER DELETE ON revision_text BEGIN
+		INSERT INTO content2idx (content2idx, rowid, url_id, retrieved, title, ttext, stems) VALUES ('delete', old.id, old.url_id, old.retrieved, old.title, old.ttext, old.stems);
+	END`,
+		`CREATE TRIGGER revision_text_au AFTER UPDATE ON revision_text BEGIN
+		INSERT INTO content2idx (content2idx, rowid, url_id, retrieved, title, ttext, stems) VALUES ('delete', old.id, old.url_id, old.retrieved, old.title, old.ttext, old.stems);
+		INSERT INTO content2idx (rowid, url_id, retrieved, title, ttext, stems) VALUES (new.id, new.url_id, new.retrieved, new.title, new.ttext, new.stems);
+	END`)
+}
+
+func migrateSavedSearches() error {
+	return execAll(`CREATE TABLE saved_searches (
+		id integer primary key,
+		query text not null,
+		created integer not null,
+		checked_until integer not null
+	)`,
+		`CREATE TABLE saved_search_hits (
+		search_id integer not null,
+		url_id integer not null,
+		retrieved integer not null,
+		found integer not null,
+		seen boolean not null default 0,
+		primary key (search_id, url_id, retrieved)
+	)`)
+}
+
+func schemaVersion() int {
+	if !hasTable("schema_version") {
+		return 0
+	}
+	stmt, err := dbConn.Prepare("SELECT version FROM schema_version")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec())
+	if !stmt.Next() {
+		return 0
+	}
+	var v int
+	must(stmt.Scan(&v))
+	return v
+}
+
+func pendingMigrations() []migration {
+	v := schemaVersion()
+	for i := range migrations {
+		if migrations[i].version > v {
+			return migrations[i:]
+		}
+	}
+	return nil
+}
+
+func isEmptyDatabase() bool {
+	stmt, err := dbConn.Prepare("SELECT name FROM sqlite_master")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec())
+	return !stmt.Next()
+}
+
+// Brings the schema of the database up to date, a copy of dbFile is made before applying any migration to an existing database
+func migrateDatabase(dbFile string) error {
+	pending := pendingMigrations()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if !isEmptyDatabase() {
+		backup := fmt.Sprintf("%s.v%d-%s.bak", dbFile, schemaVersion(), time.Now().Format("20060102-150405"))
+		fmt.Fprintf(os.Stderr, "Upgrading database schema, saving a backup to %s\n", backup)
+		if err := copyFile(backup, dbFile); err != nil {
+			return fmt.Errorf("could not back up database: %v", err)
+		}
+	}
+
+	for _, m := range pending {
+		if err := applyMigration(m); err != nil {
+			return fmt.Errorf("migration %d (%s): %v", m.version, m.description, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(m migration) (err error) {
+	if err = dbConn.Exec("BEGIN"); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dbConn.Exec("ROLLBACK")
+		}
+	}()
+
+	if err = m.apply(); err != nil {
+		return err
+	}
+	err = execAll(`CREATE TABLE IF NOT EXISTS schema_version (version integer not null)`, `DELETE FROM schema_version`)
+	if err != nil {
+		return err
+	}
+	if err = dbConn.Exec("INSERT INTO schema_version (version) VALUES (?)", m.version); err != nil {
+		return err
+	}
+	return dbConn.Exec("COMMIT")
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func migrateCmd(dbFile string, args []string) {
+	var dryRun bool
+	fs := newSubcommandFlags("migrate")
+	fs.BoolVar(&dryRun, "dry-run", false, "Only list the migrations that would be applied")
+	if len(parseSubcommandArgs(fs, args)) != 0 {
+		usage()
+	}
+
+	pending := pendingMigrations()
+	fmt.Printf("Schema version %d, %d migrations pending\n", schemaVersion(), len(pending))
+	for _, m := range pending {
+		fmt.Printf("\t%d\t%s\n", m.version, m.description)
+	}
+	if dryRun || len(pending) == 0 {
+		return
+	}
+	must(migrateDatabase(dbFile))
+	fmt.Printf("Schema version %d\n", schemaVersion())
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keeps all revisions from the last week, one per day for the last month, one per week for the last year and one per month after that
+const DEFAULT_RETENTION_POLICY = "7d:all,30d:daily,365d:weekly,*:monthly"
+
+const (
+	secondsPerDay   = 24 * 60 * 60
+	secondsPerWeek  = 7 * secondsPerDay
+	secondsPerMonth = 30 * secondsPerDay
+	secondsPerYear  = 365 * secondsPerDay
+)
+
+// A rule of the retention policy, revisions younger than maxAge (-1 for no limit) are kept one per period (0 to keep all of them)
+type retentionRule struct {
+	maxAge int
+	period int
+}
+
+// Parses a retention policy, a comma separated list of <age>:<period> rules where age is a number of days (d), weeks (w), months (m), years (y) or * and period is one of all, daily, weekly, monthly, yearly
+func parseRetentionPolicy(s string) ([]retentionRule, error) {
+	r := []retentionRule{}
+	for _, rs := range strings.Split(s, ",") {
+		v := strings.SplitN(strings.TrimSpace(rs), ":", 2)
+		if len(v) != 2 {
+			return nil, fmt.Errorf("bad retention rule %q", rs)
+		}
+
+		var rule retentionRule
+		if v[0] == "*" {
+			rule.maxAge = -1
+		} else {
+			if len(v[0]) < 2 {
+				return nil, fmt.Errorf("bad age %q", v[0])
+			}
+			n, err := strconv.Atoi(v[0][:len(v[0])-1])
+			if err != nil {
+				return nil, fmt.Errorf("bad age %q", v[0])
+			}
+			switch v[0][len(v[0])-1] {
+			case 'd':
+				rule.maxAge = n * secondsPerDay
+			case 'w':
+				rule.maxAge = n * secondsPerWeek
+			case 'm':
+				rule.maxAge = n * secondsPerMonth
+			case 'y':
+				rule.maxAge = n * secondsPerYear
+			default:
+				return nil, fmt.Errorf("bad age %q", v[0])
+			}
+		}
+
+		switch v[1] {
+		case "all":
+			rule.period = 0
+		case "daily":
+			rule.period = secondsPerDay
+		case "weekly":
+			rule.period = secondsPerWeek
+		case "monthly":
+			rule.period = secondsPerMonth
+		case "yearly":
+			rule.period = secondsPerYear
+		default:
+			return nil, fmt.Errorf("bad period %q", v[1])
+		}
+
+		r = append(r, rule)
+	}
+	return r, nil
+}
+
+// Selects the revisions to keep, revisions are sorted oldest first. The most recent revision of each period is kept, as is the most recent revision overall. Revisions older than the oldest rule are removed.
+func applyRetentionPolicy(policy []retentionRule, revs []RevisionContent, now int) []RevisionContent {
+	seen := map[[2]int]bool{}
+	keep := make([]bool, len(revs))
+	for i := len(revs) - 1; i >= 0; i-- {
+		if i == len(revs)-1 {
+			keep[i] = true
+			continue
+		}
+		age := now - revs[i].RetrievedDate
+		for j, rule := range policy {
+			if rule.maxAge >= 0 && age > rule.maxAge {
+				continue
+			}
+			if rule.period == 0 {
+				keep[i] = true
+				break
+			}
+			bucket := [2]int{j, revs[i].RetrievedDate / rule.period}
+			if !seen[bucket] {
+				seen[bucket] = true
+				keep[i] = true
+			}
+			break
+		}
+	}
+
+	r := []RevisionContent{}
+	for i := range revs {
+		if keep[i] {
+			r = append(r, revs[i])
+		}
+	}
+	return r
+}
+
+func pruneRevisionsCmd(args []string) {
+	var policyStr, urlId string
+	var dryRun bool
+	fs := newSubcommandFlags("prune-revisions")
+	fs.StringVar(&policyStr, "policy", DEFAULT_RETENTION_POLICY, "Retention policy")
+	fs.StringVar(&urlId, "url", "", "Only prune the url with this id")
+	fs.BoolVar(&dryRun, "dry-run", false, "Only report what would be removed")
+	if len(parseSubcommandArgs(fs, args)) != 0 {
+		usage()
+	}
+
+	policy, err := parseRetentionPolicy(policyStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	ids := listUrlIds()
+	if urlId != "" {
+		id, err := strconv.Atoi(urlId)
+		if err != nil {
+			usage()
+		}
+		ids = []int{id}
+	}
+
+	now := int(time.Now().Unix())
+	removed := 0
+	for _, id := range ids {
+		u, ok := getUrl(id)
+		if !ok || !u.IsImportant {
+			continue
+		}
+
+		revs, err := u.AllRevisions()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %d %s: %v\n", u.Id, u.Url, err)
+			continue
+		}
+		if !dryRun {
+			beginTransaction()
+		}
+		kept := applyRetentionPolicy(policy, revs, now)
+		if len(kept) < len(revs) {
+			fmt.Printf("%d\t%d -> %d revisions\t%s\n", u.Id, len(revs), len(kept), u.Url)
+			removed += len(revs) - len(kept)
+			if !dryRun {
+				u.ReplaceRevisions(kept)
+			}
+		}
+		if !dryRun {
+			commitTransaction()
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("Would remove %d revisions\n", removed)
+	} else {
+		fmt.Printf("Removed %d revisions\n", removed)
+		collectGarbage()
+	}
+}
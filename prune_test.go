@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseRetentionPolicy(t *testing.T) {
+	policy, err := parseRetentionPolicy(DEFAULT_RETENTION_POLICY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []retentionRule{{7 * secondsPerDay, 0}, {30 * secondsPerDay, secondsPerDay}, {365 * secondsPerDay, secondsPerWeek}, {-1, secondsPerMonth}}
+	if len(policy) != len(want) {
+		t.Fatalf("parsed %v, want %v", policy, want)
+	}
+	for i := range want {
+		if policy[i] != want[i] {
+			t.Errorf("rule %d parsed as %v, want %v", i, policy[i], want[i])
+		}
+	}
+
+	policy, err = parseRetentionPolicy("2w:all, 1m:weekly, 2y:yearly")
+	if err != nil || len(policy) != 3 || policy[0].maxAge != 2*secondsPerWeek || policy[1].maxAge != secondsPerMonth || policy[2] != (retentionRule{2 * secondsPerYear, secondsPerYear}) {
+		t.Errorf("parsed %v, %v", policy, err)
+	}
+
+	for _, s := range []string{"", "7d", "d:all", "7x:all", "xd:all", "7d:hourly", "7d:all,"} {
+		if _, err := parseRetentionPolicy(s); err == nil {
+			t.Errorf("%q parsed without errors", s)
+		}
+	}
+}
+
+func TestApplyRetentionPolicy(t *testing.T) {
+	day := secondsPerDay
+	now := 1000 * day
+	policy, err := parseRetentionPolicy("7d:all,30d:daily,*:monthly")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dates := []int{
+		now - 400*day + 3600, // same month as the next one
+		now - 400*day + 7200,
+		now - 100*day,
+		now - 10*day + 1000, // same day as the next one
+		now - 10*day + 2000,
+		now - 2*day - 3600, // every revision of the last week is kept
+		now - 2*day,
+		now - day,
+	}
+	revs := []RevisionContent{}
+	for _, d := range dates {
+		revs = append(revs, RevisionContent{d, nil})
+	}
+	want := []int{dates[1], dates[2], dates[4], dates[5], dates[6], dates[7]}
+
+	kept := applyRetentionPolicy(policy, revs, now)
+	if len(kept) != len(want) {
+		t.Fatalf("kept %v, want %v", kept, want)
+	}
+	for i := range want {
+		if kept[i].RetrievedDate != want[i] {
+			t.Errorf("kept %v, want %v", kept, want)
+			break
+		}
+	}
+
+	// revisions older than every rule are removed, except the most recent one
+	policy, _ = parseRetentionPolicy("7d:all")
+	kept = applyRetentionPolicy(policy, revs[:5], now)
+	if len(kept) != 1 || kept[0].RetrievedDate != dates[4] {
+		t.Errorf("kept %v, want only the most recent revision", kept)
+	}
+}
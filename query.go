@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+	"unicode"
+)
+
+// Filters of the search query language, each store translates them to its own conditions
+const (
+	FILTER_SITE      = "site"
+	FILTER_BEFORE    = "before"
+	FILTER_AFTER     = "after"
+	FILTER_IMPORTANT = "important"
+	FILTER_TAG       = "tag"
+	FILTER_TYPE      = "type"
+)
+
+// A filter on the revisions matched by a search. Date is used by before: (retrieved up to Date) and after: (retrieved after Date), the others use Value:
+// a lowercase host, on any port unless it has one, for site:, yes or no for important:, a mime type where * matches anything for type:
+type queryFilter struct {
+	Kind    string
+	Negated bool
+	Value   string
+	Date    int
+}
+
+// A parsed search query: words and phrases go to the full text index, filters restrict the urls and revisions searched
+type searchQuery struct {
+	terms   []string
+	negated []string
+	filters []queryFilter
+}
+
+// Splits q at spaces outside of double quotes
+func splitQuery(q string) ([]string, error) {
+	r := []string{}
+	var cur []rune
+	inQuote, started := false, false
+	for _, ch := range q {
+		switch {
+		case ch == '"':
+			inQuote = !inQuote
+			cur = append(cur, ch)
+			started = true
+		case unicode.IsSpace(ch) && !inQuote:
+			if started {
+				r = append(r, string(cur))
+			}
+			cur, started = cur[:0], false
+		default:
+			cur = append(cur, ch)
+			started = true
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("missing closing quote")
+	}
+	if started {
+		r = append(r, string(cur))
+	}
+	return r, nil
+}
+
+func unquote(s string) string {
+	return strings.Replace(s, `"`, "", -1)
+}
+
+// Parses a search query. Besides words and "quoted phrases" it understands:
+//
+//	site:<host>	urls on host or its subdomains
+//	before:<date>, after:<date>	revisions retrieved up to the end of date, or after it
+//	important:yes|no
+//	tag:<tag>
+//	type:<type>	content type, either a mime type (image/* works) or an extension like pdf
+//
+// words, phrases, site:, tag: and type: can be negated with a leading -
+func parseQuery(q string) (*searchQuery, error) {
+	toks, err := splitQuery(q)
+	if err != nil {
+		return nil, err
+	}
+
+	sq := &searchQuery{}
+	for _, tok := range toks {
+		neg := false
+		if len(tok) > 1 && tok[0] == '-' {
+			neg, tok = true, tok[1:]
+		}
+
+		v := strings.SplitN(tok, ":", 2)
+		if len(v) != 2 || strings.HasPrefix(tok, `"`) {
+			if t := unquote(tok); t != "" {
+				if neg {
+					sq.negated = append(sq.negated, t)
+				} else {
+					sq.terms = append(sq.terms, t)
+				}
+			}
+			continue
+		}
+
+		key, val := v[0], unquote(v[1])
+		if val == "" {
+			return nil, fmt.Errorf("%s: needs a value", key)
+		}
+		f := queryFilter{Kind: key, Negated: neg, Value: val}
+		switch key {
+		case FILTER_SITE:
+			f.Value = strings.ToLower(strings.TrimSuffix(val, "/"))
+		case FILTER_BEFORE, FILTER_AFTER:
+			if neg {
+				return nil, fmt.Errorf("%s: can not be negated, use %s", key, map[string]string{FILTER_BEFORE: "after:", FILTER_AFTER: "before:"}[key])
+			}
+			date, err := parseDate(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			f.Value, f.Date = "", date
+		case FILTER_IMPORTANT:
+			if neg {
+				return nil, fmt.Errorf("important: can not be negated, use important:no")
+			}
+			if val != "yes" && val != "no" {
+				return nil, fmt.Errorf("important: must be yes or no, not %q", val)
+			}
+		case FILTER_TAG:
+		case FILTER_TYPE:
+			mt, err := queryContentType(val)
+			if err != nil {
+				return nil, err
+			}
+			f.Value = mt
+		default:
+			// not a filter, a word with a colon in it
+			if neg {
+				sq.negated = append(sq.negated, unquote(tok))
+			} else {
+				sq.terms = append(sq.terms, unquote(tok))
+			}
+			continue
+		}
+		sq.filters = append(sq.filters, f)
+	}
+
+	if len(sq.terms) == 0 && len(sq.negated) > 0 {
+		return nil, fmt.Errorf("excluding words needs at least one word to search for")
+	}
+	if len(sq.terms) == 0 && len(sq.filters) == 0 {
+		return nil, fmt.Errorf("nothing to search for")
+	}
+	return sq, nil
+}
+
+// Returns the mime type for the value of a type: filter
+func queryContentType(val string) (string, error) {
+	if strings.Contains(val, "/") {
+		return strings.ToLower(val), nil
+	}
+	mt, _, err := mime.ParseMediaType(mime.TypeByExtension("." + val))
+	if err != nil {
+		return "", fmt.Errorf("type: unknown type %q, use an extension like pdf or a mime type like image/*", val)
+	}
+	return mt, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		q       string
+		terms   []string
+		negated []string
+		filters []queryFilter
+	}{
+		{"apples pears", []string{"apples", "pears"}, nil, nil},
+		{`"apples and pears" -"green apples" -bananas`, []string{"apples and pears"}, []string{"green apples", "bananas"}, nil},
+		{`  apples   "a  b"  `, []string{"apples", "a  b"}, nil, nil},
+		{"site:Example.com/ apples", []string{"apples"}, nil, []queryFilter{{Kind: FILTER_SITE, Value: "example.com"}}},
+		{"apples -site:example.com", []string{"apples"}, nil, []queryFilter{{Kind: FILTER_SITE, Negated: true, Value: "example.com"}}},
+		{"before:1000 after:500", nil, nil, []queryFilter{{Kind: FILTER_BEFORE, Date: 1000}, {Kind: FILTER_AFTER, Date: 500}}},
+		{"important:yes", nil, nil, []queryFilter{{Kind: FILTER_IMPORTANT, Value: "yes"}}},
+		{`tag:"to read" -tag:done`, nil, nil, []queryFilter{{Kind: FILTER_TAG, Value: "to read"}, {Kind: FILTER_TAG, Negated: true, Value: "done"}}},
+		{"type:pdf -type:Image/*", nil, nil, []queryFilter{{Kind: FILTER_TYPE, Value: "application/pdf"}, {Kind: FILTER_TYPE, Negated: true, Value: "image/*"}}},
+		{"c++ note:this -re:that", []string{"c++", "note:this"}, []string{"re:that"}, nil},
+		{`"site:example.com"`, []string{"site:example.com"}, nil, nil},
+		{"- apples", []string{"-", "apples"}, nil, nil},
+	}
+	for _, test := range tests {
+		sq, err := parseQuery(test.q)
+		if err != nil {
+			t.Errorf("%s: %v", test.q, err)
+			continue
+		}
+		if !reflect.DeepEqual(sq.terms, test.terms) || !reflect.DeepEqual(sq.negated, test.negated) || !reflect.DeepEqual(sq.filters, test.filters) {
+			t.Errorf("%s: parsed as %q %q %+v, want %q %q %+v", test.q, sq.terms, sq.negated, sq.filters, test.terms, test.negated, test.filters)
+		}
+	}
+}
+
+func TestParseQueryDates(t *testing.T) {
+	sq, err := parseQuery("before:2020-01-10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	end, _ := parseDate("2020-01-10")
+	if len(sq.filters) != 1 || sq.filters[0].Date != end {
+		t.Errorf("parsed as %+v", sq.filters)
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, q := range []string{
+		"",
+		"   ",
+		`"apples`,
+		"-apples",
+		"site:",
+		"apples -before:2020-01-01",
+		"after:yesterday",
+		"important:maybe",
+		"-important:yes",
+		"type:nosuchtype",
+	} {
+		if sq, err := parseQuery(q); err == nil {
+			t.Errorf("%q parsed as %+v", q, sq)
+		}
+	}
+}
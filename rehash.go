@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+var legacyAdditionalRe = regexp.MustCompile(`/additional/[0-9a-f]{40}`)
+
+// Moves all additional resources from SHA-1 ids to SHA-256 ids, rewriting the references inside stored revisions
+func rehashCmd(args []string) {
+	var dryRun bool
+	fs := newSubcommandFlags("rehash")
+	fs.BoolVar(&dryRun, "dry-run", false, "Only report what would be changed")
+	if len(parseSubcommandArgs(fs, args)) != 0 {
+		usage()
+	}
+
+	if !dryRun {
+		beginTransaction()
+	}
+
+	renamed := map[string]string{}
+	for _, oldId := range listLegacyContentAddressableIds() {
+		_, content, ok := GetContentAddressable(oldId)
+		if !ok {
+			continue
+		}
+		if !verifyContentAddressableId(oldId, content) {
+			fmt.Fprintf(os.Stderr, "Resource %s does not match its id, skipping\n", oldId)
+			continue
+		}
+		newId := contentAddressableId(content)
+		renamed[oldId] = newId
+		if !dryRun {
+			renameContentAddressable(oldId, newId)
+		}
+	}
+
+	urls, broken := 0, 0
+	for _, id := range listUrlIds() {
+		u, ok := getUrl(id)
+		if !ok {
+			continue
+		}
+		revs, err := u.AllRevisions()
+		if err != nil {
+			// its references to the old ids could not be rewritten
+			fmt.Fprintf(os.Stderr, "Can not rewrite %d %s: %v\n", u.Id, u.Url, err)
+			broken++
+			continue
+		}
+		changed := false
+		for i := range revs {
+			c := legacyAdditionalRe.ReplaceAllFunc(revs[i].Content, func(ref []byte) []byte {
+				if newId, ok := renamed[string(ref[len(additionalPrefix):])]; ok {
+					return []byte(additionalPrefix + newId)
+				}
+				return ref
+			})
+			if !bytes.Equal(c, revs[i].Content) {
+				revs[i].Content = c
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		urls++
+		if dryRun {
+			fmt.Printf("Would rewrite %d revisions of %s\n", len(revs), u.Url)
+		} else {
+			fmt.Printf("Rewriting %d revisions of %s\n", len(revs), u.Url)
+			u.ReplaceRevisions(revs)
+		}
+	}
+
+	if broken > 0 {
+		if !dryRun {
+			rollbackTransaction()
+		}
+		fmt.Fprintf(os.Stderr, "%d urls can not be reconstructed, nothing was changed, run fsck\n", broken)
+		os.Exit(1)
+	}
+
+	if !dryRun {
+		commitTransaction()
+	}
+
+	fmt.Printf("%d resources rehashed, %d urls rewritten\n", len(renamed), urls)
+	if !dryRun {
+		collectGarbage()
+	}
+}
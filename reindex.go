@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/net/html"
+	"os"
+	"strconv"
+)
+
+// Extracts title and text from content, a page retrieved from url
+func extractText(url string, content []byte) (title, text string) {
+	node, err := html.Parse(bytes.NewReader(content))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error parsing %s as HTML: %v\n", url, err)
+		return "", ""
+	}
+	title, text, err = htmlExtract(node)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error extracting text from %s: %v\n", url, err)
+	}
+	return title, text
+}
+
+// Extracts again the text of every stored revision of u and stores it in the full text index, also detects again the content type of u
+func (u *Url) Reindex() int {
+	revs, err := u.AllRevisions()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Indexing only the revisions of %s that can be reconstructed: %v\n", u.Url, err)
+	}
+	for _, rev := range revs {
+		title, text := extractText(u.Url, rev.Content)
+		u.StoreContent2(rev.RetrievedDate, title, text)
+	}
+	if len(revs) > 0 {
+		u.SetContentType(revs[len(revs)-1].Content)
+	}
+	archive.DeleteStaleText(u)
+	return len(revs)
+}
+
+// Rebuilds the full text index of every url (or of a single url) from the stored revisions
+func reindexCmd(args []string) {
+	var urlId string
+	fs := newSubcommandFlags("reindex")
+	fs.StringVar(&urlId, "url", "", "Only reindex the url with this id")
+	if len(parseSubcommandArgs(fs, args)) != 0 {
+		usage()
+	}
+	m := archiveMaintenance()
+
+	ids := listUrlIds()
+	if urlId != "" {
+		id, err := strconv.Atoi(urlId)
+		if err != nil {
+			usage()
+		}
+		ids = []int{id}
+	}
+
+	revs := 0
+	for _, id := range ids {
+		u, ok := getUrl(id)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "No url with id %d\n", id)
+			continue
+		}
+		beginTransaction()
+		revs += u.Reindex()
+		commitTransaction()
+	}
+	if urlId == "" {
+		// also repairs an index that no longer matches the extracted text
+		m.RebuildIndex()
+	}
+
+	fmt.Printf("Reindexed %d revisions of %d urls\n", revs, len(ids))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Repairs urls left half stored by an update that was interrupted before urls were processed in a single transaction: urls without content are removed, urls missing from the full text index are extracted again from their last revision
+func repairArchive() {
+	m, ok := archive.(MaintenanceStore)
+	if !ok {
+		return
+	}
+
+	beginTransaction()
+	defer func() {
+		if err := recover(); err != nil {
+			rollbackTransaction()
+			panic(err)
+		}
+	}()
+
+	for _, id := range m.UrlsWithoutContent() {
+		u, ok := getUrl(id)
+		if !ok {
+			continue
+		}
+		fmt.Printf("Removing url without content: %s\n", u.Url)
+		u.Remove()
+	}
+
+	for _, id := range m.UrlsWithoutText() {
+		u, ok := getUrl(id)
+		if !ok {
+			continue
+		}
+		fmt.Printf("Indexing url missing from the full text index: %s\n", u.Url)
+		u.Reindex()
+	}
+
+	commitTransaction()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+type RevisionContent struct {
+	RetrievedDate int
+	Content       []byte
+}
+
+// Encodes content for storage, as a diff from prev when that's significantly shorter. diffs is the number of diffs stored since the last full revision, prev is nil if there is no previous revision
+func encodeRevision(content, prev []byte, diffs int) (cc []byte, isdiff bool, codec, encoding string) {
+	encoding = diffEncodingFlag
+	if prev == nil || diffs > MAX_DIFFS || (encoding == DIFF_BSDIFF && len(content) > MAX_STORE_SIZE) {
+		if debugProcessing {
+			fmt.Printf("Compression\n")
+		}
+		cc, codec = maybeCompress(content)
+		return cc, false, codec, encoding
+	}
+	if debugProcessing {
+		fmt.Printf("Compression and diff\n")
+	}
+	cc, isdiff, codec = maybeDiffCompress(content, prev, encoding)
+	return cc, isdiff, codec, encoding
+}
+
+// Calls f, turning panics into errors
+func tryCatch(f func()) (err error) {
+	defer func() {
+		if ierr := recover(); ierr != nil {
+			err = fmt.Errorf("%v", ierr)
+		}
+	}()
+	f()
+	return nil
+}
+
+// Replays a chain of stored revisions, oldest first
+type revisionChain struct {
+	base []byte // last full revision
+	cur  []byte // last revision reconstructed
+}
+
+// Reconstructs sr, the revision following the ones already replayed. After an error the chain restarts from the next full revision
+func (c *revisionChain) next(sr StoredRevision) (content []byte, err error) {
+	if sr.Err != nil {
+		c.base, c.cur = nil, nil
+		return nil, sr.Err
+	}
+	if sr.IsDiff && c.cur == nil {
+		return nil, fmt.Errorf("diff without a previous full revision")
+	}
+	err = tryCatch(func() {
+		content = decompress(sr.Content, sr.Codec)
+		switch {
+		case !sr.IsDiff:
+		case sr.Encoding == DIFF_BSDIFF_BASE:
+			content = applyDiff(c.base, content, sr.Encoding)
+		default:
+			content = applyDiff(c.cur, content, sr.Encoding)
+		}
+	})
+	if err != nil {
+		c.base, c.cur = nil, nil
+		return nil, err
+	}
+	if !sr.IsDiff {
+		c.base = content
+	}
+	c.cur = content
+	return content, nil
+}
+
+// Returns an error if sr has a hash and content, its reconstruction, doesn't match it
+func checkRevisionHash(sr StoredRevision, content []byte) error {
+	if sr.Hash != "" && contentAddressableId(content) != sr.Hash {
+		return fmt.Errorf("reconstructed revision does not match its hash")
+	}
+	return nil
+}
+
+// Reconstructs the last of revs, a full revision followed by the diffs after it, and returns it with the number of diffs. Stores use it to implement GetContent
+func replayRevisions(u *Url, revs []StoredRevision) ([]byte, int, bool) {
+	if len(revs) == 0 {
+		return []byte{}, 0, false
+	}
+
+	var chain revisionChain
+	var content []byte
+	for _, sr := range revs {
+		var err error
+		content, err = chain.next(sr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can not reconstruct revision %d of %s: %v\n", sr.RetrievedDate, u.Url, err)
+			return []byte{}, 0, false
+		}
+	}
+	if err := checkRevisionHash(revs[len(revs)-1], content); err != nil {
+		fmt.Fprintf(os.Stderr, "Can not reconstruct revision %d of %s: %v\n", revs[len(revs)-1].RetrievedDate, u.Url, err)
+		return []byte{}, 0, false
+	}
+
+	return content, len(revs) - 1, true
+}
+
+// Reconstructs every stored revision of u, oldest first. Revisions that can not be reconstructed are left out and reported by the error, callers rewriting the revisions of u must not do it if there is one
+func (u *Url) AllRevisions() ([]RevisionContent, error) {
+	r := []RevisionContent{}
+	var chain revisionChain
+	var firstErr error
+	broken := 0
+	stored := archive.StoredRevisions(u)
+	for _, sr := range stored {
+		content, err := chain.next(sr)
+		if err == nil {
+			err = checkRevisionHash(sr, content)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("revision %d: %v", sr.RetrievedDate, err)
+			}
+			broken++
+			continue
+		}
+		r = append(r, RevisionContent{sr.RetrievedDate, content})
+	}
+	if broken > 0 {
+		return r, fmt.Errorf("%d of %d revisions can not be reconstructed, %v", broken, len(stored), firstErr)
+	}
+	return r, nil
+}
+
+// Replaces all stored revisions of u with revs, rebuilding the chain of diffs. Must be called inside a transaction.
+func (u *Url) ReplaceRevisions(revs []RevisionContent) {
+	archive.DeleteRevisions(u)
+	var prev []byte
+	diffs := 0
+	for _, rev := range revs {
+		cc, isdiff, codec, encoding := encodeRevision(rev.Content, prev, diffs)
+		if isdiff {
+			diffs++
+		} else {
+			diffs = 0
+		}
+		u.StoreContentAt(cc, isdiff, codec, encoding, contentAddressableId(rev.Content), rev.RetrievedDate)
+		prev = rev.Content
+	}
+	archive.DeleteStaleText(u)
+}
+
+// Deletes the blobs that are no longer referenced after revisions or resources were rewritten
+func collectGarbage() {
+	m, ok := archive.(MaintenanceStore)
+	if !ok {
+		return
+	}
+	blobs, bytes := m.CollectGarbage()
+	if blobs > 0 {
+		fmt.Printf("Deleted %d unreferenced blobs, %d bytes\n", blobs, bytes)
+	}
+}
+
+func beginTransaction() {
+	archive.Begin()
+}
+
+func commitTransaction() {
+	archive.Commit()
+}
+
+func rollbackTransaction() {
+	archive.Rollback()
+}
+
+// Rebuilds the chains of revisions of every url (or of a single url) choosing full revisions and diffs with the current settings
+func repackCmd(args []string) {
+	var urlId string
+	fs := newSubcommandFlags("repack")
+	fs.StringVar(&urlId, "url", "", "Only repack the url with this id")
+	if len(parseSubcommandArgs(fs, args)) != 0 {
+		usage()
+	}
+
+	ids := listUrlIds()
+	if urlId != "" {
+		id, err := strconv.Atoi(urlId)
+		if err != nil {
+			usage()
+		}
+		ids = []int{id}
+	}
+
+	totalBefore, totalAfter := 0, 0
+	for _, id := range ids {
+		u, ok := getUrl(id)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "No url with id %d\n", id)
+			continue
+		}
+		revs, err := u.AllRevisions()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %d %s: %v\n", u.Id, u.Url, err)
+			continue
+		}
+		before := u.StoredSize()
+		beginTransaction()
+		u.ReplaceRevisions(revs)
+		commitTransaction()
+		after := u.StoredSize()
+		if before != after {
+			fmt.Printf("%d\t%d -> %d bytes\t%s\n", u.Id, before, after, u.Url)
+		}
+		totalBefore += before
+		totalAfter += after
+	}
+
+	fmt.Printf("Repacked %d urls, %d -> %d bytes (%d saved)\n", len(ids), totalBefore, totalAfter, totalBefore-totalAfter)
+	collectGarbage()
+
+	if m, ok := archive.(MaintenanceStore); ok {
+		fmt.Printf("Vacuuming\n")
+		m.Compact()
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Returns a page of n lines where line i changes with version
+func testPage(n, version int) []byte {
+	lines := []string{}
+	for i := 0; i < n; i++ {
+		if i%10 == version%10 {
+			lines = append(lines, fmt.Sprintf("line %d of version %d", i, version))
+		} else {
+			lines = append(lines, fmt.Sprintf("line %d, the same in every version", i))
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+func testRevisions(versions int) []RevisionContent {
+	r := []RevisionContent{}
+	for v := 0; v < versions; v++ {
+		r = append(r, RevisionContent{1000 + v*100, testPage(200, v)})
+	}
+	return r
+}
+
+func TestReplaceRevisions(t *testing.T) {
+	openTestArchive(t, "")
+	diffEncodingFlag = DIFF_TOKENS
+	u := Lookup("http://example.com/", true, 0)
+	revs := testRevisions(MAX_DIFFS + 5)
+	u.ReplaceRevisions(revs)
+
+	stored := archive.StoredRevisions(&u)
+	if len(stored) != len(revs) {
+		t.Fatalf("%d revisions stored, want %d", len(stored), len(revs))
+	}
+	diffs := 0
+	for _, sr := range stored {
+		if sr.IsDiff {
+			diffs++
+		}
+	}
+	if diffs == 0 || diffs == len(stored) {
+		t.Errorf("%d of %d revisions stored as diffs", diffs, len(stored))
+	}
+
+	got, err := u.AllRevisions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(revs) {
+		t.Fatalf("%d revisions reconstructed, want %d", len(got), len(revs))
+	}
+	for i := range revs {
+		if got[i].RetrievedDate != revs[i].RetrievedDate || !bytes.Equal(got[i].Content, revs[i].Content) {
+			t.Errorf("revision %d reconstructed as %d %q", revs[i].RetrievedDate, got[i].RetrievedDate, got[i].Content)
+		}
+	}
+
+	content, _, ok := u.GetContent(-1)
+	if !ok || !bytes.Equal(content, revs[len(revs)-1].Content) {
+		t.Errorf("last revision is %q", content)
+	}
+	for _, rev := range []RevisionContent{revs[0], revs[3], revs[MAX_DIFFS+2]} {
+		content, _, ok := u.GetContent(rev.RetrievedDate + 50)
+		if !ok || !bytes.Equal(content, rev.Content) {
+			t.Errorf("revision at %d is %q", rev.RetrievedDate+50, content)
+		}
+	}
+	if _, _, ok := u.GetContent(revs[0].RetrievedDate - 1); ok {
+		t.Errorf("content found before the first revision")
+	}
+}
+
+func TestBrokenChain(t *testing.T) {
+	openTestArchive(t, "")
+	diffEncodingFlag = DIFF_TOKENS
+	u := Lookup("http://example.com/", true, 0)
+	revs := testRevisions(5)
+	u.ReplaceRevisions(revs)
+
+	// corrupts the second revision, the diffs after it can't be reconstructed either
+	stored := archive.StoredRevisions(&u)
+	if stored[0].IsDiff || !stored[1].IsDiff {
+		t.Fatalf("revisions not stored as a full revision followed by diffs")
+	}
+	must(dbConn.Exec("update content set content = ? where url_id = ? and retrieved = ?", []byte("garbage"), u.Id, stored[1].RetrievedDate))
+
+	got, err := u.AllRevisions()
+	if err == nil {
+		t.Fatalf("no error for a broken chain")
+	}
+	if len(got) != 1 || !bytes.Equal(got[0].Content, revs[0].Content) {
+		t.Errorf("%d revisions reconstructed from a broken chain, want only the first", len(got))
+	}
+	if _, _, ok := u.GetContent(-1); ok {
+		t.Errorf("content reconstructed from a broken chain")
+	}
+	if content, _, ok := u.GetContent(revs[0].RetrievedDate); !ok || !bytes.Equal(content, revs[0].Content) {
+		t.Errorf("revision before the broken diff is %q", content)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	openTestArchive(t, "")
+	diffEncodingFlag = DIFF_TOKENS
+	u := Lookup("http://example.com/", true, 0)
+	revs := testRevisions(3)
+	u.ReplaceRevisions(revs)
+
+	beginTransaction()
+	u.ReplaceRevisions(revs[:1])
+	if n := len(archive.StoredRevisions(&u)); n != 1 {
+		t.Errorf("%d revisions inside the transaction, want 1", n)
+	}
+	rollbackTransaction()
+
+	got, err := u.AllRevisions()
+	if err != nil || len(got) != len(revs) {
+		t.Errorf("%d revisions after rollback, want %d (%v)", len(got), len(revs), err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DEFAULT_SEARCH_LIMIT = 20
+
+type jsonSearchResult struct {
+	Id      int    `json:"id"`
+	Url     string `json:"url"`
+	Title   string `json:"title"`
+	Snippet string `json:"snippet"`
+	Dates   []int  `json:"dates"`
+}
+
+type jsonSearchResults struct {
+	Query   string             `json:"query"`
+	Page    int                `json:"page,omitempty"`
+	Total   int                `json:"total"`
+	Error   string             `json:"error,omitempty"`
+	Results []jsonSearchResult `json:"results"`
+	Facets  []Facet            `json:"facets,omitempty"`
+}
+
+func newJSONSearchResults(q string, total int, results []Result) *jsonSearchResults {
+	jr := &jsonSearchResults{Query: q, Total: total, Results: []jsonSearchResult{}}
+	for _, res := range results {
+		id, _ := strconv.Atoi(res.UrlId)
+		jr.Results = append(jr.Results, jsonSearchResult{id, res.Url, res.Title, res.PlainSnippet(), res.Dates})
+	}
+	return jr
+}
+
+// Returns the snippet of the result without the highlighting markers
+func (r Result) PlainSnippet() string {
+	return strings.Replace(strings.Replace(r.Snippet, SNIPPET_START, "", -1), SNIPPET_END, "", -1)
+}
+
+// Prints the results of a search, one per line as tab separated id, url, title, date of the last matching revision and snippet, or as JSON
+func searchCmd(args []string) {
+	var jsonOut bool
+	var limit int
+	fs := newSubcommandFlags("search")
+	fs.BoolVar(&jsonOut, "json", false, "Prints the results as JSON")
+	fs.IntVar(&limit, "limit", DEFAULT_SEARCH_LIMIT, "Maximum number of results")
+	args = parseSubcommandArgs(fs, args)
+	if len(args) == 0 || limit <= 0 {
+		usage()
+	}
+
+	q := strings.Join(args, " ")
+	results, total, err := search(q, 0, limit)
+	if err != nil {
+		if jsonOut {
+			jr := newJSONSearchResults(q, 0, nil)
+			jr.Error = err.Error()
+			must(json.NewEncoder(os.Stdout).Encode(jr))
+		} else {
+			fmt.Fprintf(os.Stderr, "Bad query: %v\n", err)
+		}
+		os.Exit(1)
+	}
+
+	if jsonOut {
+		must(json.NewEncoder(os.Stdout).Encode(newJSONSearchResults(q, total, results)))
+		return
+	}
+
+	clean := strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+	for _, res := range results {
+		date := ""
+		if len(res.Dates) > 0 {
+			date = time.Unix(int64(res.Dates[0]), 0).Format("2006-01-02")
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\n", res.UrlId, res.Url, clean.Replace(res.Title), date, clean.Replace(res.PlainSnippet()))
+	}
+	if total > len(results) {
+		fmt.Fprintf(os.Stderr, "%d of %d results\n", len(results), total)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Adds a url to the archive with a revision retrieved at retrieved
+func testUrl(url string, important bool, retrieved int, title, text string) Url {
+	u := Lookup(url, important, retrieved)
+	archive.InsertRevision(&u, StoredRevision{Revision{retrieved, CODEC_NONE, false, DIFF_TOKENS, len(text)}, contentAddressableId([]byte(text)), []byte(text), nil})
+	archive.StoreText(&u, retrieved, title, text, "", "")
+	return u
+}
+
+func searchUrls(t *testing.T, q string) []string {
+	results, total, err := search(q, 0, 10)
+	if err != nil {
+		t.Fatalf("%s: %v", q, err)
+	}
+	if total != len(results) {
+		t.Errorf("%s: %d results of %d", q, len(results), total)
+	}
+	r := []string{}
+	for _, res := range results {
+		r = append(r, res.Url)
+	}
+	return r
+}
+
+func TestSearchFilters(t *testing.T) {
+	openTestArchive(t, "")
+	day := 24 * 60 * 60
+	jan := int(time.Date(2020, 1, 10, 12, 0, 0, 0, time.Local).Unix())
+	a := testUrl("https://www.example.com/a", true, jan, "Apples", "apples and pears")
+	testUrl("https://example.org/b", false, jan+30*day, "Pears", "only pears")
+	c := testUrl("https://docs.example.com/c.pdf", false, jan+60*day, "Report", "apples in a report")
+	a.SetTags([]string{"fruit"})
+	archive.SetContentType(&c, "application/pdf")
+
+	tests := []struct {
+		q    string
+		urls []string
+	}{
+		{"apples", []string{"https://www.example.com/a", "https://docs.example.com/c.pdf"}},
+		{"pears -apples", []string{"https://example.org/b"}},
+		{"site:example.com", []string{"https://docs.example.com/c.pdf", "https://www.example.com/a"}},
+		{"pears -site:example.com", []string{"https://example.org/b"}},
+		{"apples important:no", []string{"https://docs.example.com/c.pdf"}},
+		{"tag:fruit", []string{"https://www.example.com/a"}},
+		{"apples -tag:fruit", []string{"https://docs.example.com/c.pdf"}},
+		{"type:pdf", []string{"https://docs.example.com/c.pdf"}},
+		{"type:application/*", []string{"https://docs.example.com/c.pdf"}},
+		{"before:2020-01-10", []string{"https://www.example.com/a"}},
+		{"pears after:2020-01-10", []string{"https://example.org/b"}},
+		{"\"and pears\"", []string{"https://www.example.com/a"}},
+		{"bananas", []string{}},
+	}
+	for _, test := range tests {
+		urls := searchUrls(t, test.q)
+		if len(urls) != len(test.urls) {
+			t.Errorf("%s: found %v, want %v", test.q, urls, test.urls)
+			continue
+		}
+		for i := range urls {
+			if urls[i] != test.urls[i] {
+				t.Errorf("%s: found %v, want %v", test.q, urls, test.urls)
+				break
+			}
+		}
+	}
+}
+
+func TestFacetRefinements(t *testing.T) {
+	openTestArchive(t, "")
+	jan := int(time.Date(2020, 1, 10, 12, 0, 0, 0, time.Local).Unix())
+	testUrl("http://localhost:8080/a", false, jan, "Apples", "apples")
+	testUrl("https://www.example.com/b", true, jan, "Apples", "apples")
+	testUrl("https://example.com:8443/c", false, jan, "Apples", "apples")
+
+	facets, err := searchFacets("apples")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range facets {
+		if f.Name != FACET_DOMAIN && f.Name != FACET_IMPORTANCE {
+			continue
+		}
+		for _, v := range f.Values {
+			// every refinement finds as many urls as the facet counted
+			if urls := searchUrls(t, "apples "+v.Filter); len(urls) != v.Count {
+				t.Errorf("%s: found %v, the facet counted %d", v.Filter, urls, v.Count)
+			}
+		}
+	}
+	if urls := searchUrls(t, "site:example.com:8443"); len(urls) != 1 {
+		t.Errorf("site:example.com:8443 found %v, want only that port", urls)
+	}
+}
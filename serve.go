@@ -2,12 +2,15 @@ package main
 
 import (
 	"camlistore.org/pkg/osutil"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net"
 	"net/http"
+	"os"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -18,8 +21,14 @@ func serve() {
 	http.HandleFunc("/search", searchHandler)
 	http.HandleFunc("/content2", content2Handler)
 	http.HandleFunc("/content", contentHandler)
+	http.HandleFunc("/export", exportHandler)
 	http.HandleFunc("/url", urlHandler)
+	http.HandleFunc("/crawl", crawlHandler)
 	http.HandleFunc("/additional/", additionalHandler)
+	http.HandleFunc("/missing", missingHandler)
+	http.HandleFunc("/stats", statsHandler)
+	http.HandleFunc("/alerts", alertsHandler)
+	http.HandleFunc("/history", historyHandler)
 	http.HandleFunc("/", indexHandler)
 
 	nl, _ := net.Listen("tcp", "127.0.0.1:0")
@@ -58,6 +67,7 @@ var indexPage = template.Must(template.New("indexPage").Parse(`
 		<form action="search" method="get">
 		Search: <input name="q" type="text" value=""/>
 		</form>
+		<p><a href="missing">Pages with missing resources</a> <a href="stats">Storage statistics</a> <a href="alerts">Saved searches</a></p>
 		<table>
 			<th>
 				<tr>
@@ -69,7 +79,7 @@ var indexPage = template.Must(template.New("indexPage").Parse(`
 			</th>
 			{{range .}}
 			<tr>
-				<td><a href="url?id={{.Id}}">{{.Id}}</a></td>
+				<td><a href="url?id={{.Id}}&details=1">{{.Id}}</a></td>
 				<td><a href="content2?id={{.Id}}">extract</a></td>
 				<td><a href="{{.Url}}">source</a></td>
 				<td><a href="url?id={{.Id}}">{{.Title}}</a><br>{{.Url}}</td>
@@ -97,11 +107,15 @@ func urlHandler(w http.ResponseWriter, r *http.Request) {
 		indexHandler(w, r)
 	}
 	urlRevisions := url.listUrlRevisions()
-	if len(urlRevisions) == 1 {
+	skipped := url.listSkippedResources()
+	subpages := url.listSubpages()
+	depth, maxPages, _ := url.GetCrawlConfig()
+	_, _, language, _ := url.GetContent2()
+	if len(urlRevisions) == 1 && len(skipped) == 0 && len(subpages) == 0 && r.URL.Query().Get("details") == "" {
 		w.Header().Add("Location", fmt.Sprintf("content?id=%d&retrieved_date=%d", id, urlRevisions[0].RetrievedDate))
 		w.WriteHeader(302)
 	} else {
-		must(urlPage.Execute(w, map[string]interface{}{"url": url, "revs": urlRevisions}))
+		must(urlPage.Execute(w, map[string]interface{}{"url": url, "revs": urlRevisions, "skipped": skipped, "subpages": subpages, "depth": depth, "maxPages": maxPages, "tags": url.Tags(), "language": language}))
 	}
 }
 
@@ -114,29 +128,105 @@ var urlPage = template.Must(template.New("urlPage").Parse(`
 		<p>Url id {{.url.Id}}<p>
 		<p><a href="{{.url.Url}}">{{.url.Url}}</a></p>
 		<p><a href="content2?id={{.url.Id}}">Last Extracted Text</a></p>
+		{{if .language}}<p>Language: {{.language}}</p>{{end}}
+		{{if .tags}}<p>Tags: {{range .tags}}<a href="search?q=tag:{{.}}">{{.}}</a> {{end}}</p>{{end}}
+		<p><form action="history" method="get">
+		<input name="id" type="hidden" value="{{.url.Id}}"/>
+		Find in history: <input name="q" type="text"/>
+		<input type="submit" value="Find"/>
+		</form></p>
+		<p><form action="crawl" method="post">
+		<input name="id" type="hidden" value="{{.url.Id}}"/>
+		Crawl depth: <input name="depth" type="text" value="{{.depth}}" size="3"/>
+		Max pages: <input name="maxpages" type="text" value="{{.maxPages}}" size="5"/>
+		<input type="submit" value="Set"/>
+		</form></p>
 		<table>
 			<th>
 				<tr>
 					<td>Retrieved Date</td>
-					<td>IsGz</td>
+					<td>Codec</td>
 					<td>IsDiff</td>
+					<td>Encoding</td>
 					<td>Size</td>
+					<td>Export</td>
 				</tr>
 			</th>
 			{{$id := .url.Id}}
 			{{range .revs}}
 			<tr>
 				<td><a href="content?id={{$id}}&retrieved_date={{.RetrievedDate}}">{{.RetrievedDate}}</a></td>
-				<td>{{.IsGz}}</td>
+				<td>{{.Codec}}</td>
 				<td>{{.IsDiff}}</td>
+				<td>{{if .IsDiff}}{{.Encoding}}{{end}}</td>
 				<td>{{.Size}}</td>
+				<td><a href="export?id={{$id}}&retrieved_date={{.RetrievedDate}}">html</a> <a href="export?id={{$id}}&retrieved_date={{.RetrievedDate}}&format=mhtml">mhtml</a></td>
+			</tr>
+			{{end}}
+		</table>
+		{{if .subpages}}
+		<p>Subpages</p>
+		<table>
+			{{range .subpages}}
+			<tr>
+				<td><a href="url?id={{.Id}}">{{.Id}}</a></td>
+				<td><a href="url?id={{.Id}}">{{.Title}}</a><br>{{.Url}}</td>
 			</tr>
 			{{end}}
 		</table>
+		{{end}}
+		{{if .skipped}}
+		<p>Skipped resources</p>
+		<table>
+			<th>
+				<tr>
+					<td>Retrieved Date</td>
+					<td>Url</td>
+					<td>Reason</td>
+				</tr>
+			</th>
+			{{range .skipped}}
+			<tr>
+				<td>{{.RetrievedDate}}</td>
+				<td><a href="{{.Url}}">{{.Url}}</a></td>
+				<td>{{.Reason}}</td>
+			</tr>
+			{{end}}
+		</table>
+		{{end}}
 	</body>
 </html>
 `))
 
+func crawlHandler(w http.ResponseWriter, r *http.Request) {
+	serveMutex.Lock()
+	defer serveMutex.Unlock()
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	depth, err := strconv.Atoi(r.FormValue("depth"))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	maxPages, err := strconv.Atoi(r.FormValue("maxpages"))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	url, ok := getUrl(id)
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	url.SetCrawlConfig(depth, maxPages)
+	w.Header().Add("Location", fmt.Sprintf("url?id=%d&details=1", id))
+	w.WriteHeader(303)
+}
+
 func contentHandler(w http.ResponseWriter, r *http.Request) {
 	serveMutex.Lock()
 	defer serveMutex.Unlock()
@@ -162,10 +252,49 @@ func contentHandler(w http.ResponseWriter, r *http.Request) {
 		indexHandler(w, r)
 	}
 	content, _, ok := url.GetContent(retrievedDate)
+	content = rewriteLinks(url.Url, retrievedDate, content)
 	w.Header().Add("Content-Type", "text/html")
 	w.Write(content)
 }
 
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	serveMutex.Lock()
+	defer serveMutex.Unlock()
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	retrievedDate, err := strconv.Atoi(r.URL.Query().Get("retrieved_date"))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	url, ok := getUrl(id)
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	var content []byte
+	contentType, ext := "text/html", "html"
+	if r.URL.Query().Get("format") == "mhtml" {
+		content, ok = url.ExportMHTML(retrievedDate)
+		contentType, ext = "multipart/related", "mhtml"
+	} else {
+		content, ok = url.ExportPage(retrievedDate)
+	}
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	w.Header().Add("Content-Type", contentType)
+	w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=\"urlarchive-%d-%d.%s\"", id, retrievedDate, ext))
+	w.Write(content)
+}
+
+const SEARCH_PAGE_SIZE = 20
+
 func searchHandler(w http.ResponseWriter, r *http.Request) {
 	serveMutex.Lock()
 	defer serveMutex.Unlock()
@@ -175,13 +304,53 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 	if ok {
 		q = qs[0]
 	}
+	page, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
 
 	results := []Result{}
-	if ok {
-		results = search(q)
+	facets := []Facet{}
+	total := 0
+	errstr := ""
+	if ok && q != "" {
+		results, total, err = search(q, (page-1)*SEARCH_PAGE_SIZE, SEARCH_PAGE_SIZE)
+		if err == nil {
+			facets, err = searchFacets(q)
+		}
+		if err != nil {
+			errstr = err.Error()
+		}
 	}
 
-	must(serPage.Execute(w, map[string]interface{}{"q": q, "results": results}))
+	if r.FormValue("format") == "json" {
+		jr := newJSONSearchResults(q, total, results)
+		jr.Page, jr.Error, jr.Facets = page, errstr, facets
+		// headers must be set before the status is written
+		w.Header().Add("Content-Type", "application/json")
+		if errstr != "" {
+			w.WriteHeader(400)
+		}
+		must(json.NewEncoder(w).Encode(jr))
+		return
+	}
+
+	args := map[string]interface{}{"q": q, "results": results, "total": total, "page": page, "err": errstr, "facets": facets}
+	if page > 1 {
+		args["prev"] = page - 1
+	}
+	if page*SEARCH_PAGE_SIZE < total {
+		args["next"] = page + 1
+	}
+	must(serPage.Execute(w, args))
+}
+
+// Returns the snippet of the result with the matching terms highlighted
+func (r Result) HighlightedSnippet() template.HTML {
+	s := template.HTMLEscapeString(r.Snippet)
+	s = strings.Replace(s, SNIPPET_START, "<mark>", -1)
+	s = strings.Replace(s, SNIPPET_END, "</mark>", -1)
+	return template.HTML(s)
 }
 
 var serPage = template.Must(template.New("serPage").Parse(`
@@ -193,6 +362,12 @@ var serPage = template.Must(template.New("serPage").Parse(`
 		<p><form action="search" method="get">
 		Query: <input name="q" type="text" value="{{.q}}"/>
 		</form></p>
+		<p><small>Words and "quoted phrases", -word excludes it. Filters: site:example.com before:YYYY-MM-DD after:YYYY-MM-DD important:yes|no tag:name type:pdf, site: tag: and type: can be negated too.</small></p>
+		{{if .err}}<p>Search error: {{.err}}</p>{{end}}
+		{{if .q}}<p>{{.total}} results</p>{{end}}
+		{{range .facets}}{{if .Values}}
+		<p>{{.Name}}: {{range .Values}}<a href="search?q={{printf "%s %s" $.q .Filter}}">{{.Value}}</a> ({{.Count}}) {{end}}</p>
+		{{end}}{{end}}
 		<table>
 			<th>
 				<tr>
@@ -206,8 +381,22 @@ var serPage = template.Must(template.New("serPage").Parse(`
 				<td><a href="{{.Url}}">source</a></td>
 				<td><a href="url?id={{.UrlId}}">{{.Title}}</a></td>
 			</tr>
+			<tr>
+				<td></td>
+				<td></td>
+				<td>{{.HighlightedSnippet}}</td>
+			</tr>
+			<tr>
+				<td></td>
+				<td></td>
+				<td>{{$id := .UrlId}}Found in: {{range .Dates}}<a href="content?id={{$id}}&retrieved_date={{.}}">{{.}}</a> {{end}}</td>
+			</tr>
 			{{end}}
 		</table>
+		<p>
+		{{if .prev}}<a href="search?q={{.q}}&page={{.prev}}">previous</a>{{end}}
+		{{if .next}}<a href="search?q={{.q}}&page={{.next}}">next</a>{{end}}
+		</p>
 	</body>
 </html>
 `))
@@ -228,7 +417,7 @@ func content2Handler(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		indexHandler(w, r)
 	}
-	title, text, _ := url.GetContent2()
+	title, text, _, _ := url.GetContent2()
 	must(content2Page.Execute(w, map[string]interface{}{"url": url, "title": title, "text": text}))
 }
 
@@ -247,19 +436,284 @@ var content2Page = template.Must(template.New("content2Page").Parse(`
 </html>
 `))
 
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	serveMutex.Lock()
+	defer serveMutex.Unlock()
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	url, ok := getUrl(id)
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	must(historyPage.Execute(w, map[string]interface{}{"url": url, "h": url.PhraseHistory(r.FormValue("q"))}))
+}
+
+var historyPage = template.Must(template.New("historyPage").Parse(`
+<html>
+	<head>
+		<title>{{.h.Phrase}} in {{.url.Url}}</title>
+	</head>
+	<body>
+		<p><a href="url?id={{.url.Id}}&details=1">{{.url.Url}}</a></p>
+		<p><form action="history" method="get">
+		<input name="id" type="hidden" value="{{.url.Id}}"/>
+		Find in history: <input name="q" type="text" value="{{.h.Phrase}}"/>
+		<input type="submit" value="Find"/>
+		</form></p>
+		{{$id := .url.Id}}
+		{{if .h.Err}}<p>Only the first {{.h.Revisions}} revisions were searched: {{.h.Err}}</p>{{end}}
+		{{if .h.Matches}}
+		<p>Found in {{.h.Matches}} of {{.h.Revisions}} revisions</p>
+		<table>
+			<tr>
+				<td>First found</td>
+				<td><a href="content?id={{$id}}&retrieved_date={{.h.First}}">{{.h.First}}</a></td>
+				<td>{{if .h.Before}}not in the revision before, <a href="content?id={{$id}}&retrieved_date={{.h.Before}}">{{.h.Before}}</a>{{else}}in the first revision{{end}}</td>
+			</tr>
+			<tr>
+				<td>Last found</td>
+				<td><a href="content?id={{$id}}&retrieved_date={{.h.Last}}">{{.h.Last}}</a></td>
+				<td>{{if .h.After}}not in the revision after, <a href="content?id={{$id}}&retrieved_date={{.h.After}}">{{.h.After}}</a>{{else}}in the last revision{{end}}</td>
+			</tr>
+		</table>
+		{{else if .h.Phrase}}
+		<p>Not found in any of the {{.h.Revisions}} revisions</p>
+		{{end}}
+	</body>
+</html>
+`))
+
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	serveMutex.Lock()
+	defer serveMutex.Unlock()
+
+	errstr := ""
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "add":
+			if _, err := addSavedSearch(r.FormValue("q")); err != nil {
+				errstr = err.Error()
+			}
+		case "remove":
+			id, err := strconv.Atoi(r.FormValue("id"))
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			removeSavedSearch(id)
+		case "seen":
+			markHitsSeen()
+		}
+		if errstr == "" {
+			w.Header().Add("Location", "alerts")
+			w.WriteHeader(303)
+			return
+		}
+	}
+
+	must(alertsPage.Execute(w, map[string]interface{}{"searches": listSavedSearches(), "hits": listNewHits(), "err": errstr, "q": r.FormValue("q")}))
+}
+
+var alertsPage = template.Must(template.New("alertsPage").Parse(`
+<html>
+	<head>
+		<title>Saved searches</title>
+	</head>
+	<body>
+		<p><form action="alerts" method="post">
+		<input name="action" type="hidden" value="add"/>
+		Save search: <input name="q" type="text" value="{{.q}}"/>
+		<input type="submit" value="Save"/>
+		</form></p>
+		{{if .err}}<p>Search error: {{.err}}</p>{{end}}
+		<table>
+			{{range .searches}}
+			<tr>
+				<td>{{.Id}}</td>
+				<td><a href="search?q={{.Query}}">{{.Query}}</a></td>
+				<td>{{.NewHits}} new</td>
+				<td><form action="alerts" method="post"><input name="action" type="hidden" value="remove"/><input name="id" type="hidden" value="{{.Id}}"/><input type="submit" value="Remove"/></form></td>
+			</tr>
+			{{end}}
+		</table>
+		{{if .hits}}
+		<p>New matches</p>
+		<table>
+			<th>
+				<tr>
+					<td>Search</td>
+					<td>Retrieved Date</td>
+					<td>Title</td>
+				</tr>
+			</th>
+			{{range .hits}}
+			<tr>
+				<td>{{.Query}}</td>
+				<td><a href="content?id={{.UrlId}}&retrieved_date={{.RetrievedDate}}">{{.RetrievedDate}}</a></td>
+				<td><a href="url?id={{.UrlId}}&details=1">{{if .Title}}{{.Title}}{{else}}{{.Url}}{{end}}</a></td>
+			</tr>
+			{{end}}
+		</table>
+		<p><form action="alerts" method="post"><input name="action" type="hidden" value="seen"/><input type="submit" value="Mark all as seen"/></form></p>
+		{{end}}
+	</body>
+</html>
+`))
+
+func missingHandler(w http.ResponseWriter, r *http.Request) {
+	serveMutex.Lock()
+	defer serveMutex.Unlock()
+
+	must(missingPage.Execute(w, listPagesMissingResources()))
+}
+
+var missingPage = template.Must(template.New("missingPage").Parse(`
+<html>
+	<head>
+		<title>Pages with missing resources</title>
+	</head>
+	<body>
+		<table>
+			<th>
+				<tr>
+					<td>Id</td>
+					<td>Missing</td>
+					<td>Last Retrieved</td>
+					<td>Url</td>
+				</tr>
+			</th>
+			{{range .}}
+			<tr>
+				<td><a href="url?id={{.Id}}&details=1">{{.Id}}</a></td>
+				<td>{{.Missing}}</td>
+				<td>{{.LastRetrieve}}</td>
+				<td><a href="url?id={{.Id}}&details=1">{{.Url}}</a></td>
+			</tr>
+			{{end}}
+		</table>
+	</body>
+</html>
+`))
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	serveMutex.Lock()
+	defer serveMutex.Unlock()
+
+	if _, ok := archive.(MaintenanceStore); !ok {
+		w.WriteHeader(404)
+		return
+	}
+	must(statsPage.Execute(w, computeStats()))
+}
+
+var statsPage = template.Must(template.New("statsPage").Parse(`
+<html>
+	<head>
+		<title>Storage statistics</title>
+	</head>
+	<body>
+		<p>Urls: {{.Urls}}</p>
+		<table>
+			<th>
+				<tr>
+					<td></td>
+					<td>Rows</td>
+					<td>Bytes</td>
+				</tr>
+			</th>
+			{{range .Sizes}}
+			<tr>
+				<td>{{.Name}}</td>
+				<td>{{.Count}}</td>
+				<td>{{.Bytes}}</td>
+			</tr>
+			{{end}}
+			<tr>
+				<td>total</td>
+				<td></td>
+				<td>{{.Total}}</td>
+			</tr>
+		</table>
+		<p>Average chain length: {{printf "%.2f" .AvgChainLength}} revisions</p>
+		<p>Compression ratio: {{printf "%.3f" .CompressionRate}}</p>
+		<p>Resource dedupe savings: {{.DedupeSavings}} bytes</p>
+		<p>Top urls by size</p>
+		<table>
+			{{range .TopUrls}}
+			<tr>
+				<td>{{.Bytes}}</td>
+				<td>{{.Count}} revisions</td>
+				<td><a href="url?id={{.Id}}&details=1">{{.Name}}</a></td>
+			</tr>
+			{{end}}
+		</table>
+		<p>Top domains by size</p>
+		<table>
+			{{range .TopDomains}}
+			<tr>
+				<td>{{.Bytes}}</td>
+				<td>{{.Count}} urls</td>
+				<td>{{.Name}}</td>
+			</tr>
+			{{end}}
+		</table>
+	</body>
+</html>
+`))
+
 func additionalHandler(w http.ResponseWriter, r *http.Request) {
 	serveMutex.Lock()
 	defer serveMutex.Unlock()
 
 	name := path.Base(r.URL.Path)
-	contentType, content, ok := GetContentAddressable(name)
+	contentType, content, codec, ok := GetContentAddressableRaw(name)
 	if !ok {
 		w.WriteHeader(404)
 		return
 	}
 
+	decoded, ok := decompressResource(name, content, codec)
+	if !ok {
+		w.WriteHeader(500)
+		return
+	}
+	if !verifyContentAddressableId(name, decoded) {
+		fmt.Fprintf(os.Stderr, "Resource %s does not match its id\n", name)
+		w.WriteHeader(500)
+		return
+	}
+
+	if codec != CODEC_NONE {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsEncoding(r, codec) {
+			w.Header().Add("Content-Encoding", codec)
+		} else {
+			content = decoded
+		}
+	}
+
 	w.Header().Add("Content-Type", contentType)
 	w.WriteHeader(200)
 
 	w.Write(content)
 }
+
+// Returns true if the client accepts responses with the specified content encoding
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		v := strings.Split(enc, ";")
+		if strings.TrimSpace(v[0]) != encoding {
+			continue
+		}
+		if len(v) > 1 && strings.Replace(v[1], " ", "", -1) == "q=0" {
+			return false
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,847 @@
+package main
+
+import (
+	"code.google.com/p/gosqlite/sqlite"
+	"fmt"
+	neturl "net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Store keeping everything in a SQLite database, blobs go where blobs puts them
+type sqliteStore struct {
+	conn  *sqlite.Conn
+	blobs blobStorage
+}
+
+func NewSQLiteStore(conn *sqlite.Conn) Store {
+	return &sqliteStore{conn, inlineBlobs{}}
+}
+
+// Returns a store that keeps revision contents and resources in a content addressed directory, and everything else in conn
+func NewDirStore(conn *sqlite.Conn, dir string) Store {
+	return &sqliteStore{conn, dirBlobs{dir}}
+}
+
+func (s *sqliteStore) Lookup(url string, important bool, lastVisit int) Url {
+	return s.lookup(url, important, lastVisit, true)
+}
+
+func (s *sqliteStore) lookup(url string, important bool, lastVisit int, recur bool) (r Url) {
+	r.Url = url
+	stmt, err := s.conn.Prepare("select id, important, last_visit from urls where url = ?")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec(url))
+	if stmt.Next() {
+		r.IsNew = false
+		must(stmt.Scan(&r.Id, &r.IsImportant, &r.LastVisit))
+
+		if r.IsImportant {
+			// Don't have to update last visit or to change the value for the important field
+			return
+		}
+
+		r.IsImportant = important
+		r.LastVisit = lastVisit
+
+		must(s.conn.Exec("update urls set important = ?, last_visit = ? where id = ?", r.IsImportant, r.LastVisit, r.Id))
+		return
+	} else {
+		if !recur {
+			fmt.Fprintf(os.Stderr, "Could not insert url %s in database\n", url)
+			os.Exit(1)
+		}
+		must(s.conn.Exec("insert into urls(url, important, last_visit) values (?, ?, ?)", url, important, lastVisit))
+		r := s.lookup(url, important, lastVisit, false)
+		r.IsNew = true
+		return r
+	}
+}
+
+func (s *sqliteStore) FindUrl(url string) (id int, ok bool) {
+	stmt, err := s.conn.Prepare("select id from urls where url = ?")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec(url))
+	if !stmt.Next() {
+		return 0, false
+	}
+	must(stmt.Scan(&id))
+	return id, true
+}
+
+func (s *sqliteStore) GetUrl(id int) (r Url, ok bool) {
+	stmt, err := s.conn.Prepare("select url, important, last_visit from urls where id = ?")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec(id))
+	if !stmt.Next() {
+		ok = false
+		return
+	}
+	r.Id = id
+	must(stmt.Scan(&r.Url, &r.IsImportant, &r.LastVisit))
+	ok = true
+	return
+}
+
+func (s *sqliteStore) ListUrls() []Url {
+	stmt, err := s.conn.Prepare("select id, url, important, last_visit, (select title from revision_text where url_id = urls.id order by retrieved desc limit 1) from urls where id in (select url_id from revision_text) and (bookmarked or id not in (select url_id from subpages))")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec())
+	r := make([]Url, 0)
+	for stmt.Next() {
+		var url Url
+		must(stmt.Scan(&url.Id, &url.Url, &url.IsImportant, &url.LastVisit, &url.Title))
+		r = append(r, url)
+	}
+	return r
+}
+
+func (s *sqliteStore) ListUrlIds() []int {
+	stmt, err := s.conn.Prepare("select distinct url_id from content order by url_id")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec())
+	r := []int{}
+	for stmt.Next() {
+		var id int
+		must(stmt.Scan(&id))
+		r = append(r, id)
+	}
+	return r
+}
+
+func (s *sqliteStore) CountUrls() int {
+	return s.queryInt("select count(*) from urls")
+}
+
+func (s *sqliteStore) RemoveUrl(u *Url) {
+	must(s.conn.Exec("delete from urls where id = ?", u.Id))
+	must(s.conn.Exec("delete from crawl_config where url_id = ?", u.Id))
+	must(s.conn.Exec("delete from subpages where parent_id = ? or url_id = ?", u.Id, u.Id))
+	must(s.conn.Exec("delete from tags where url_id = ?", u.Id))
+}
+
+func (s *sqliteStore) SetBookmarked(u *Url) {
+	must(s.conn.Exec("update urls set bookmarked = 1 where id = ?", u.Id))
+}
+
+func (s *sqliteStore) SetContentType(u *Url, mimeType string) {
+	must(s.conn.Exec("update urls set contenttype = ? where id = ?", mimeType, u.Id))
+}
+
+func (s *sqliteStore) SetTags(u *Url, tags []string) {
+	must(s.conn.Exec("delete from tags where url_id = ?", u.Id))
+	for _, tag := range tags {
+		must(s.conn.Exec("insert or ignore into tags (url_id, tag) values (?, ?)", u.Id, tag))
+	}
+}
+
+func (s *sqliteStore) Tags(u *Url) []string {
+	stmt, err := s.conn.Prepare("select tag from tags where url_id = ? order by tag")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec(u.Id))
+	r := []string{}
+	for stmt.Next() {
+		var tag string
+		must(stmt.Scan(&tag))
+		r = append(r, tag)
+	}
+	return r
+}
+
+func (s *sqliteStore) GetCrawlConfig(u *Url) (depth, maxPages int, ok bool) {
+	stmt, err := s.conn.Prepare("select depth, max_pages from crawl_config where url_id = ?")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec(u.Id))
+	if !stmt.Next() {
+		return 0, 0, false
+	}
+	must(stmt.Scan(&depth, &maxPages))
+	return depth, maxPages, true
+}
+
+func (s *sqliteStore) SetCrawlConfig(u *Url, depth, maxPages int) {
+	must(s.conn.Exec("insert or replace into crawl_config (url_id, depth, max_pages) values (?, ?, ?)", u.Id, depth, maxPages))
+}
+
+func (s *sqliteStore) AddSubpage(parent, sub *Url) {
+	must(s.conn.Exec("insert or ignore into subpages (parent_id, url_id) values (?, ?)", parent.Id, sub.Id))
+}
+
+func (s *sqliteStore) ListSubpages(u *Url) []Url {
+	stmt, err := s.conn.Prepare("select id, url, important, last_visit, ifnull((select title from revision_text where url_id = urls.id order by retrieved desc limit 1), '') from urls inner join subpages on urls.id = subpages.url_id where subpages.parent_id = ? order by url")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec(u.Id))
+	r := []Url{}
+	for stmt.Next() {
+		var url Url
+		must(stmt.Scan(&url.Id, &url.Url, &url.IsImportant, &url.LastVisit, &url.Title))
+		r = append(r, url)
+	}
+	return r
+}
+
+func (s *sqliteStore) GetContent(u *Url, atDate int) ([]byte, int, bool) {
+	// the chain is replayed from the last full revision at atDate
+	var revs []StoredRevision
+	if atDate < 0 {
+		revs = s.storedRevisions("select isdiff, codec, encoding, ifnull(hash, ''), retrieved, content, ifnull(blob, '') from content where url_id = ? and retrieved >= (select max(retrieved) from content where url_id = ? and isdiff = 0) order by retrieved asc", u.Id, u.Id)
+	} else {
+		revs = s.storedRevisions("select isdiff, codec, encoding, ifnull(hash, ''), retrieved, content, ifnull(blob, '') from content where url_id = ? and retrieved >= (select max(retrieved) from content where url_id = ? and isdiff = 0 and retrieved <= ?) and retrieved <= ? order by retrieved asc", u.Id, u.Id, atDate, atDate)
+	}
+	return replayRevisions(u, revs)
+}
+
+func (s *sqliteStore) StoredRevisions(u *Url) []StoredRevision {
+	return s.storedRevisions("select isdiff, codec, encoding, ifnull(hash, ''), retrieved, content, ifnull(blob, '') from content where url_id = ? order by retrieved asc", u.Id)
+}
+
+func (s *sqliteStore) storedRevisions(query string, args ...interface{}) []StoredRevision {
+	stmt, err := s.conn.Prepare(query)
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec(args...))
+	r := []StoredRevision{}
+	for stmt.Next() {
+		var rev StoredRevision
+		var content []byte
+		var ref string
+		must(stmt.Scan(&rev.IsDiff, &rev.Codec, &rev.Encoding, &rev.Hash, &rev.RetrievedDate, &content, &ref))
+		rev.Content, rev.Err = s.blobs.get(content, ref)
+		rev.Size = len(rev.Content)
+		r = append(r, rev)
+	}
+	return r
+}
+
+func (s *sqliteStore) ListRevisions(u *Url) []Revision {
+	stmt, err := s.conn.Prepare("select retrieved, codec, isdiff, encoding, length(content), ifnull(blob, '') from content where url_id = ?")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec(u.Id))
+	r := []Revision{}
+	for stmt.Next() {
+		var rev Revision
+		var size int
+		var ref string
+		must(stmt.Scan(&rev.RetrievedDate, &rev.Codec, &rev.IsDiff, &rev.Encoding, &size, &ref))
+		rev.Size = s.blobs.size(size, ref)
+		r = append(r, rev)
+	}
+	return r
+}
+
+func (s *sqliteStore) InsertRevision(u *Url, rev StoredRevision) {
+	content, ref := s.blobs.put(rev.Content)
+	must(s.conn.Exec("insert into content (url_id, isdiff, codec, encoding, hash, retrieved, content, blob) values (?, ?, ?, ?, ?, ?, ?, nullif(?, ''))", u.Id, rev.IsDiff, rev.Codec, rev.Encoding, rev.Hash, rev.RetrievedDate, content, ref))
+}
+
+func (s *sqliteStore) UpdateRevision(u *Url, rev StoredRevision) {
+	content, ref := s.blobs.put(rev.Content)
+	must(s.conn.Exec("update content set isdiff = ?, codec = ?, encoding = ?, hash = ?, retrieved = ?, content = ?, blob = nullif(?, '') where url_id = ?", rev.IsDiff, rev.Codec, rev.Encoding, rev.Hash, rev.RetrievedDate, content, ref, u.Id))
+}
+
+func (s *sqliteStore) DeleteRevisions(u *Url) {
+	must(s.conn.Exec("delete from content where url_id = ?", u.Id))
+}
+
+func (s *sqliteStore) StoredSize(u *Url) int {
+	r := 0
+	for _, rev := range s.ListRevisions(u) {
+		r += rev.Size
+	}
+	return r
+}
+
+func (s *sqliteStore) StoreText(u *Url, retrieved int, title, text, language, stems string) {
+	// not insert or replace, it doesn't run the delete trigger that keeps content2idx up to date
+	must(s.conn.Exec("delete from revision_text where url_id = ? and retrieved = ?", u.Id, retrieved))
+	must(s.conn.Exec("insert into revision_text (url_id, retrieved, title, ttext, language, stems) values (?, ?, ?, ?, ?, ?)", u.Id, retrieved, title, text, language, stems))
+}
+
+func (s *sqliteStore) GetText(u *Url) (title, text, language string, ok bool) {
+	stmt, err := s.conn.Prepare("select title, ttext, language from revision_text where url_id = ? order by retrieved desc limit 1")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec(u.Id))
+	if !stmt.Next() {
+		ok = false
+		return
+	}
+	must(stmt.Scan(&title, &text, &language))
+	ok = true
+	return
+}
+
+func (s *sqliteStore) DeleteStaleText(u *Url) {
+	must(s.conn.Exec("delete from revision_text where url_id = ? and retrieved not in (select retrieved from content where url_id = ?)", u.Id, u.Id))
+}
+
+func (s *sqliteStore) StoreResource(url, contentType string, content []byte) string {
+	contentId := contentAddressableId(content)
+	codec := CODEC_NONE
+	if compressibleType(contentType) {
+		content, codec = maybeCompress(content)
+	}
+	content, ref := s.blobs.put(content)
+	must(s.conn.Exec("insert or ignore into additional(contentid, url, contenttype, codec, content, blob) values (?, ?, ?, ?, ?, nullif(?, ''))", contentId, url, contentType, codec, content, ref))
+	return contentId
+}
+
+func (s *sqliteStore) GetResource(id string) (contentType string, content []byte, codec string, ok bool) {
+	stmt, err := s.conn.Prepare("select contenttype, codec, content, ifnull(blob, '') from additional where contentid = ?")
+	must(err)
+	defer stmt.Finalize()
+	stmt.Exec(id)
+	if !stmt.Next() {
+		return "", nil, "", false
+	}
+
+	ok = true
+	var ref string
+	must(stmt.Scan(&contentType, &codec, &content, &ref))
+	v := make([]byte, len(content))
+	copy(v, content)
+	content, err = s.blobs.get(v, ref)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can not read resource %s: %v\n", id, err)
+		return "", nil, "", false
+	}
+	return
+}
+
+func (s *sqliteStore) ListResourceIds() []string {
+	stmt, err := s.conn.Prepare("select contentid from additional order by contentid")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec())
+	r := []string{}
+	for stmt.Next() {
+		var id string
+		must(stmt.Scan(&id))
+		r = append(r, id)
+	}
+	return r
+}
+
+func (s *sqliteStore) RenameResource(oldId, newId string) {
+	must(s.conn.Exec("insert or ignore into additional(contentid, url, contenttype, codec, content, blob) select ?, url, contenttype, codec, content, blob from additional where contentid = ?", newId, oldId))
+	must(s.conn.Exec("delete from additional where contentid = ?", oldId))
+	must(s.conn.Exec("update resource_history set contentid = ? where contentid = ?", newId, oldId))
+}
+
+func (s *sqliteStore) RecordSkippedResource(pageUrl, url, reason string, retrieved int) {
+	must(s.conn.Exec("insert into skipped_resources(page_url, url, reason, retrieved) values (?, ?, ?, ?)", pageUrl, url, reason, retrieved))
+}
+
+func (s *sqliteStore) ListSkippedResources(pageUrl string) []SkippedResource {
+	stmt, err := s.conn.Prepare("select url, reason, retrieved from skipped_resources where page_url = ? order by retrieved desc")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec(pageUrl))
+	r := []SkippedResource{}
+	for stmt.Next() {
+		var sr SkippedResource
+		must(stmt.Scan(&sr.Url, &sr.Reason, &sr.RetrievedDate))
+		r = append(r, sr)
+	}
+	return r
+}
+
+func (s *sqliteStore) ListPagesMissingResources() []PageMissingResources {
+	stmt, err := s.conn.Prepare("select urls.id, skipped_resources.page_url, count(distinct skipped_resources.url), max(skipped_resources.retrieved) from skipped_resources inner join urls on urls.url = skipped_resources.page_url group by skipped_resources.page_url order by count(distinct skipped_resources.url) desc")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec())
+	r := []PageMissingResources{}
+	for stmt.Next() {
+		var p PageMissingResources
+		must(stmt.Scan(&p.Id, &p.Url, &p.Missing, &p.LastRetrieve))
+		r = append(r, p)
+	}
+	return r
+}
+
+func (s *sqliteStore) RecordResourceFetch(url, contentId string, fetched int) {
+	must(s.conn.Exec("insert into resource_history(url, fetched, contentid) values (?, ?, ?)", url, fetched, contentId))
+}
+
+func (s *sqliteStore) ClosestResource(url string, date int) (contentId string, ok bool) {
+	// the last capture fetched by date, if there is none the first one after it
+	stmt, err := s.conn.Prepare("select contentid from resource_history where url = ? order by fetched > ?, case when fetched <= ? then -fetched else fetched end limit 1")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec(url, date, date))
+	if !stmt.Next() {
+		return "", false
+	}
+	must(stmt.Scan(&contentId))
+	return contentId, true
+}
+
+func escapeLike(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "%", `\%`, -1)
+	return strings.Replace(s, "_", `\_`, -1)
+}
+
+func ftsString(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"`
+}
+
+// Returns the fts5 expression matching the words of the query, every word is quoted so that punctuation has no special meaning. Words also match their stems, phrases and excluded words only match as they are. Empty if the query has only filters
+func ftsMatch(sq *searchQuery) string {
+	if len(sq.terms) == 0 {
+		return ""
+	}
+	pos := make([]string, len(sq.terms))
+	for i, t := range sq.terms {
+		if len(words(t)) != 1 {
+			pos[i] = ftsString(t)
+			continue
+		}
+		stems := queryStems(t)
+		for j := range stems {
+			stems[j] = ftsString(stems[j])
+		}
+		pos[i] = "(" + ftsString(t) + " OR stems : (" + strings.Join(stems, " OR ") + "))"
+	}
+	r := "(" + strings.Join(pos, " AND ") + ")"
+	for _, t := range sq.negated {
+		r += " NOT " + ftsString(t)
+	}
+	return r
+}
+
+// Returns the condition on the url_id and retrieved columns for f
+func filterSQL(f queryFilter) (string, []interface{}) {
+	var cond string
+	var args []interface{}
+	switch f.Kind {
+	case FILTER_SITE:
+		// the host, with or without a port, or one of its subdomains
+		pats := []string{}
+		for _, host := range []string{"%://", "%://%."} {
+			for _, rest := range []string{"", "/%", ":%"} {
+				pats = append(pats, "url like ? escape '\\'")
+				args = append(args, host+escapeLike(f.Value)+rest)
+			}
+		}
+		cond = "url_id in (select id from urls where " + strings.Join(pats, " or ") + ")"
+	case FILTER_BEFORE:
+		cond = "retrieved <= ?"
+		args = []interface{}{f.Date}
+	case FILTER_AFTER:
+		cond = "retrieved > ?"
+		args = []interface{}{f.Date}
+	case FILTER_IMPORTANT:
+		if f.Value == "yes" {
+			cond = "url_id in (select id from urls where important = 1)"
+		} else {
+			cond = "url_id in (select id from urls where important = 0)"
+		}
+	case FILTER_TAG:
+		cond = "url_id in (select url_id from tags where tag = ?)"
+		args = []interface{}{f.Value}
+	case FILTER_TYPE:
+		cond = "url_id in (select id from urls where contenttype like ? escape '\\')"
+		args = []interface{}{strings.Replace(escapeLike(f.Value), "*", "%", -1)}
+	default:
+		panic(fmt.Errorf("unknown filter %q", f.Kind))
+	}
+	if f.Negated {
+		cond = "not (" + cond + ")"
+	}
+	return cond, args
+}
+
+// Returns a query with one row per revision matching sq, with url_id and retrieved columns, if ranked also with title, snip and score columns.
+// The limit -1 stops sqlite from flattening it into the queries that use it, fts5 functions can not be used in an aggregate query.
+func searchRows(sq *searchQuery, ranked bool) (string, []interface{}) {
+	var inner string
+	args := []interface{}{}
+	where := []string{}
+	filterArgs := []interface{}{}
+	for _, f := range sq.filters {
+		cond, a := filterSQL(f)
+		where = append(where, cond)
+		filterArgs = append(filterArgs, a...)
+	}
+	if m := ftsMatch(sq); m != "" {
+		if ranked {
+			inner = fmt.Sprintf("select url_id, retrieved, title, snippet(content2idx, 3, '%s', '%s', '…', %d) as snip, bm25(content2idx, 0, 0, %g, 1.0, %g) as score from content2idx", SNIPPET_START, SNIPPET_END, SNIPPET_TOKENS, TITLE_WEIGHT, STEMS_WEIGHT)
+		} else {
+			inner = "select url_id, retrieved from content2idx"
+		}
+		where = append([]string{"content2idx match ?"}, where...)
+		args = append(args, m)
+	} else {
+		// only filters, newest first
+		if ranked {
+			inner = fmt.Sprintf("select url_id, retrieved, title, substr(ttext, 1, %d) as snip, -retrieved as score from revision_text", SNIPPET_TOKENS*8)
+		} else {
+			inner = "select url_id, retrieved from revision_text"
+		}
+	}
+	inner += " where " + strings.Join(where, " and ") + " limit -1"
+	return inner, append(args, filterArgs...)
+}
+
+func (s *sqliteStore) Search(sq *searchQuery, offset, limit int) (r []Result, total int, err error) {
+	counted, countArgs := searchRows(sq, false)
+	stmt, err := s.conn.Prepare("select count(distinct url_id) from (" + counted + ")")
+	must(err)
+	defer stmt.Finalize()
+	if err = stmt.Exec(countArgs...); err != nil {
+		return nil, 0, err
+	}
+	if stmt.Next() {
+		must(stmt.Scan(&total))
+	}
+
+	inner, args := searchRows(sq, true)
+	// Matching revisions are grouped by url, title and snippet come from the best matching revision
+	stmt2, err := s.conn.Prepare("select url_id, group_concat(retrieved), title, snip, min(score) from (" + inner + ") group by url_id order by min(score) limit ? offset ?")
+	must(err)
+	defer stmt2.Finalize()
+	if err = stmt2.Exec(append(args, limit, offset)...); err != nil {
+		return nil, 0, err
+	}
+	r = []Result{}
+	for stmt2.Next() {
+		var a Result
+		var dates string
+		var score float64
+		must(stmt2.Scan(&a.UrlId, &dates, &a.Title, &a.Snippet, &score))
+		for _, d := range strings.Split(dates, ",") {
+			n, err := strconv.Atoi(d)
+			if err == nil {
+				a.Dates = append(a.Dates, n)
+			}
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(a.Dates)))
+		r = append(r, a)
+	}
+
+	for i := range r {
+		id, _ := strconv.Atoi(r[i].UrlId)
+		u, ok := s.GetUrl(id)
+		if ok {
+			r[i].Url = u.Url
+		}
+	}
+	return r, total, nil
+}
+
+func (s *sqliteStore) Facets(sq *searchQuery) ([]Facet, error) {
+	inner, args := searchRows(sq, false)
+	queries := []struct {
+		name, query string
+	}{
+		{FACET_YEAR, "select strftime('%Y', retrieved, 'unixepoch', 'localtime'), count(distinct url_id) from (" + inner + ") group by 1"},
+		{FACET_MONTH, "select strftime('%Y-%m', retrieved, 'unixepoch', 'localtime'), count(distinct url_id) from (" + inner + ") group by 1"},
+		{FACET_IMPORTANCE, "select case when urls.important then 'yes' else 'no' end, count(distinct urls.id) from (" + inner + ") r inner join urls on urls.id = r.url_id group by 1"},
+		{FACET_TAG, "select tags.tag, count(distinct tags.url_id) from (" + inner + ") r inner join tags on tags.url_id = r.url_id group by 1"},
+		{FACET_TYPE, "select urls.contenttype, count(distinct urls.id) from (" + inner + ") r inner join urls on urls.id = r.url_id where urls.contenttype != '' group by 1"},
+	}
+
+	r := []Facet{}
+	domains := Facet{Name: FACET_DOMAIN}
+	stmt, err := s.conn.Prepare("select url from urls where id in (select url_id from (" + inner + "))")
+	must(err)
+	if err := stmt.Exec(args...); err != nil {
+		stmt.Finalize()
+		return nil, err
+	}
+	counts := map[string]int{}
+	for stmt.Next() {
+		var u string
+		must(stmt.Scan(&u))
+		if pu, err := neturl.Parse(u); err == nil && pu.Host != "" {
+			counts[strings.TrimPrefix(strings.ToLower(pu.Hostname()), "www.")]++
+		}
+	}
+	stmt.Finalize()
+	for host, n := range counts {
+		domains.Values = append(domains.Values, FacetValue{Value: host, Count: n})
+	}
+	r = append(r, domains)
+
+	for _, q := range queries {
+		f := Facet{Name: q.name}
+		stmt, err := s.conn.Prepare(q.query)
+		must(err)
+		if err := stmt.Exec(args...); err != nil {
+			stmt.Finalize()
+			return nil, err
+		}
+		for stmt.Next() {
+			var v FacetValue
+			must(stmt.Scan(&v.Value, &v.Count))
+			f.Values = append(f.Values, v)
+		}
+		stmt.Finalize()
+		r = append(r, f)
+	}
+	return r, nil
+}
+
+func (s *sqliteStore) AddSavedSearch(query string, created int) int {
+	must(s.conn.Exec("insert into saved_searches (query, created, checked_until) values (?, ?, ?)", query, created, created))
+	return s.queryInt("select max(id) from saved_searches")
+}
+
+func (s *sqliteStore) RemoveSavedSearch(id int) {
+	must(s.conn.Exec("delete from saved_search_hits where search_id = ?", id))
+	must(s.conn.Exec("delete from saved_searches where id = ?", id))
+}
+
+func (s *sqliteStore) ListSavedSearches() []SavedSearch {
+	stmt, err := s.conn.Prepare("select id, query, created, checked_until, (select count(*) from saved_search_hits where search_id = saved_searches.id and not seen) from saved_searches order by id")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec())
+	r := []SavedSearch{}
+	for stmt.Next() {
+		var ss SavedSearch
+		must(stmt.Scan(&ss.Id, &ss.Query, &ss.Created, &ss.CheckedUntil, &ss.NewHits))
+		r = append(r, ss)
+	}
+	return r
+}
+
+func (s *sqliteStore) AddSearchHit(searchId, urlId, retrieved, found int) bool {
+	before := s.queryInt("select count(*) from saved_search_hits where search_id = ? and url_id = ? and retrieved = ?", searchId, urlId, retrieved)
+	if before > 0 {
+		return false
+	}
+	must(s.conn.Exec("insert into saved_search_hits (search_id, url_id, retrieved, found) values (?, ?, ?, ?)", searchId, urlId, retrieved, found))
+	return true
+}
+
+func (s *sqliteStore) SetSearchChecked(searchId, checkedUntil int) {
+	must(s.conn.Exec("update saved_searches set checked_until = ? where id = ?", checkedUntil, searchId))
+}
+
+func (s *sqliteStore) ListNewHits() []SearchHit {
+	stmt, err := s.conn.Prepare(`select h.search_id, s.query, h.url_id, ifnull(urls.url, ''), ifnull(t.title, ''), h.retrieved, h.found
+		from saved_search_hits h inner join saved_searches s on s.id = h.search_id
+		left outer join urls on urls.id = h.url_id
+		left outer join revision_text t on t.url_id = h.url_id and t.retrieved = h.retrieved
+		where not h.seen order by h.found desc, h.search_id, h.retrieved desc`)
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec())
+	r := []SearchHit{}
+	for stmt.Next() {
+		var h SearchHit
+		must(stmt.Scan(&h.SearchId, &h.Query, &h.UrlId, &h.Url, &h.Title, &h.RetrievedDate, &h.Found))
+		r = append(r, h)
+	}
+	return r
+}
+
+func (s *sqliteStore) MarkHitsSeen() {
+	must(s.conn.Exec("update saved_search_hits set seen = 1 where not seen"))
+}
+
+func (s *sqliteStore) queryInt(query string, args ...interface{}) int {
+	stmt, err := s.conn.Prepare(query)
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec(args...))
+	if !stmt.Next() {
+		return 0
+	}
+	var r int
+	must(stmt.Scan(&r))
+	return r
+}
+
+func (s *sqliteStore) queryIds(query string) []int {
+	stmt, err := s.conn.Prepare(query)
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec())
+	r := []int{}
+	for stmt.Next() {
+		var id int
+		must(stmt.Scan(&id))
+		r = append(r, id)
+	}
+	return r
+}
+
+func (s *sqliteStore) ContentSizes() (content, diffs, additional SizeStat) {
+	content, diffs, additional = SizeStat{Name: "content"}, SizeStat{Name: "diffs"}, SizeStat{Name: "additional"}
+	stmt, err := s.conn.Prepare("select isdiff, length(content), ifnull(blob, '') from content")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec())
+	for stmt.Next() {
+		var isdiff bool
+		var size int
+		var ref string
+		must(stmt.Scan(&isdiff, &size, &ref))
+		ss := &content
+		if isdiff {
+			ss = &diffs
+		}
+		ss.Count++
+		ss.Bytes += s.blobs.size(size, ref)
+	}
+
+	stmt2, err := s.conn.Prepare("select length(content), ifnull(blob, '') from additional")
+	must(err)
+	defer stmt2.Finalize()
+	must(stmt2.Exec())
+	for stmt2.Next() {
+		var size int
+		var ref string
+		must(stmt2.Scan(&size, &ref))
+		additional.Count++
+		additional.Bytes += s.blobs.size(size, ref)
+	}
+	return
+}
+
+func (s *sqliteStore) UrlSizes() []SizeStat {
+	stmt, err := s.conn.Prepare("select urls.id, urls.url, length(content.content), ifnull(content.blob, '') from content inner join urls on urls.id = content.url_id order by urls.id")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec())
+	r := []SizeStat{}
+	for stmt.Next() {
+		var u SizeStat
+		var size int
+		var ref string
+		must(stmt.Scan(&u.Id, &u.Name, &size, &ref))
+		if len(r) == 0 || r[len(r)-1].Id != u.Id {
+			r = append(r, u)
+		}
+		r[len(r)-1].Count++
+		r[len(r)-1].Bytes += s.blobs.size(size, ref)
+	}
+	return r
+}
+
+func (s *sqliteStore) DedupeSavings() int {
+	stmt, err := s.conn.Prepare("select count(*), length(additional.content), ifnull(additional.blob, '') from resource_history inner join additional on additional.contentid = resource_history.contentid group by additional.contentid")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec())
+	r := 0
+	for stmt.Next() {
+		var fetches, size int
+		var ref string
+		must(stmt.Scan(&fetches, &size, &ref))
+		r += (fetches - 1) * s.blobs.size(size, ref)
+	}
+	return r
+}
+
+func (s *sqliteStore) CollectGarbage() (blobs, bytes int) {
+	stmt, err := s.conn.Prepare("select blob from content where blob is not null union select blob from additional where blob is not null")
+	must(err)
+	defer stmt.Finalize()
+	must(stmt.Exec())
+	referenced := map[string]bool{}
+	for stmt.Next() {
+		var ref string
+		must(stmt.Scan(&ref))
+		referenced[ref] = true
+	}
+	return s.blobs.removeUnreferenced(referenced)
+}
+
+// Returns the space used by the full text index, summing the shadow tables of its fts module
+func (s *sqliteStore) IndexSize() SizeStat {
+	r := SizeStat{Name: "index"}
+	r.Count = s.queryInt("select count(*) from content2idx")
+	hasTable := func(name string) bool {
+		return s.queryInt("select count(*) from sqlite_master where name = ?", name) > 0
+	}
+	switch {
+	case hasTable("content2idx_segments"): // fts3/fts4
+		r.Bytes = s.queryInt("select ifnull(sum(length(block)), 0) from content2idx_segments") +
+			s.queryInt("select ifnull(sum(length(root)), 0) from content2idx_segdir")
+	case hasTable("content2idx_data"): // fts5
+		r.Bytes = s.queryInt("select ifnull(sum(length(block)), 0) from content2idx_data")
+	}
+	switch {
+	case hasTable("revision_text"):
+		r.Bytes += s.queryInt("select ifnull(sum(length(title) + length(ttext)), 0) from revision_text")
+	case hasTable("content2idx_content"):
+		r.Bytes += s.queryInt("select ifnull(sum(length(title) + length(ttext)), 0) from content2idx")
+	}
+	return r
+}
+
+func (s *sqliteStore) UrlsWithoutContent() []int {
+	return s.queryIds("select id from urls where id not in (select url_id from content)")
+}
+
+func (s *sqliteStore) UrlsWithoutText() []int {
+	return s.queryIds("select id from urls where id in (select url_id from content) and id not in (select url_id from revision_text)")
+}
+
+func (s *sqliteStore) CheckIndex() []fsckProblem {
+	problems := []fsckProblem{}
+	queries := []struct {
+		query, descr string
+	}{
+		{"select id, url from urls where id not in (select url_id from content)", "url without content"},
+		{"select id, url from urls where id not in (select url_id from revision_text)", "url missing from the full text index"},
+		{"select distinct url_id, '' from revision_text where url_id not in (select id from urls)", "full text index entry for a url that doesn't exist"},
+		{"select distinct content.url_id, ifnull(urls.url, '') from content left outer join urls on urls.id = content.url_id where not exists (select 1 from revision_text where revision_text.url_id = content.url_id and revision_text.retrieved = content.retrieved)", "revisions missing from the full text index, run reindex"},
+		{"select distinct revision_text.url_id, ifnull(urls.url, '') from revision_text left outer join urls on urls.id = revision_text.url_id where not exists (select 1 from content where content.url_id = revision_text.url_id and content.retrieved = revision_text.retrieved)", "full text index entries for revisions that don't exist"},
+		{"select distinct url_id, '' from content where url_id not in (select id from urls)", "content for a url that doesn't exist"},
+	}
+	for _, q := range queries {
+		stmt, err := s.conn.Prepare(q.query)
+		must(err)
+		must(stmt.Exec())
+		for stmt.Next() {
+			var p fsckProblem
+			must(stmt.Scan(&p.UrlId, &p.Url))
+			p.Descr = q.descr
+			problems = append(problems, p)
+		}
+		stmt.Finalize()
+	}
+
+	// compares the index with revision_text, its external content
+	if err := s.conn.Exec("INSERT INTO content2idx (content2idx, rank) VALUES ('integrity-check', 1)"); err != nil {
+		problems = append(problems, fsckProblem{Descr: fmt.Sprintf("full text index does not match the extracted text (%v), run reindex", err)})
+	}
+	return problems
+}
+
+func (s *sqliteStore) RebuildIndex() {
+	must(s.conn.Exec("INSERT INTO content2idx (content2idx) VALUES ('rebuild')"))
+}
+
+func (s *sqliteStore) Compact() {
+	must(s.conn.Exec("VACUUM"))
+}
+
+func (s *sqliteStore) Begin() {
+	must(s.conn.Exec("BEGIN"))
+}
+
+func (s *sqliteStore) Commit() {
+	must(s.conn.Exec("COMMIT"))
+}
+
+func (s *sqliteStore) Rollback() {
+	must(s.conn.Exec("ROLLBACK"))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+)
+
+const STATS_TOP = 20
+
+type SizeStat struct {
+	Name  string
+	Id    int
+	Count int
+	Bytes int
+}
+
+type Stats struct {
+	Urls            int
+	Content         SizeStat // full revisions
+	Diffs           SizeStat
+	Additional      SizeStat
+	Index           SizeStat
+	TopUrls         []SizeStat
+	TopDomains      []SizeStat
+	AvgChainLength  float64
+	CompressionRate float64 // stored bytes / uncompressed bytes, for the content table
+	DedupeSavings   int     // bytes of additional resources that would have been stored without content addressing
+}
+
+func (s *Stats) Sizes() []SizeStat {
+	return []SizeStat{s.Content, s.Diffs, s.Additional, s.Index}
+}
+
+func (s *Stats) Total() int {
+	return s.Content.Bytes + s.Diffs.Bytes + s.Additional.Bytes + s.Index.Bytes
+}
+
+func computeStats() *Stats {
+	m := archiveMaintenance()
+	s := &Stats{}
+	s.Urls = archive.CountUrls()
+	s.Content, s.Diffs, s.Additional = m.ContentSizes()
+	s.Index = m.IndexSize()
+
+	if s.Content.Count > 0 {
+		s.AvgChainLength = float64(s.Content.Count+s.Diffs.Count) / float64(s.Content.Count)
+	}
+
+	stored, uncompressed := 0, 0
+	for _, id := range listUrlIds() {
+		for _, sr := range archive.StoredRevisions(&Url{Id: id}) {
+			if sr.Err != nil {
+				continue
+			}
+			stored += len(sr.Content)
+			uncompressed += len(decompress(sr.Content, sr.Codec))
+		}
+	}
+	if uncompressed > 0 {
+		s.CompressionRate = float64(stored) / float64(uncompressed)
+	}
+
+	s.DedupeSavings = m.DedupeSavings()
+
+	urls := m.UrlSizes()
+	domains := map[string]*SizeStat{}
+	for _, u := range urls {
+		host := u.Name
+		if pu, err := url.Parse(u.Name); err == nil && pu.Host != "" {
+			host = pu.Host
+		}
+		d, ok := domains[host]
+		if !ok {
+			d = &SizeStat{Name: host}
+			domains[host] = d
+		}
+		d.Count++
+		d.Bytes += u.Bytes
+	}
+
+	s.TopUrls = topSizes(urls)
+	s.TopDomains = []SizeStat{}
+	for _, d := range domains {
+		s.TopDomains = append(s.TopDomains, *d)
+	}
+	s.TopDomains = topSizes(s.TopDomains)
+
+	return s
+}
+
+func topSizes(v []SizeStat) []SizeStat {
+	sort.Slice(v, func(i, j int) bool { return v[i].Bytes > v[j].Bytes })
+	if len(v) > STATS_TOP {
+		v = v[:STATS_TOP]
+	}
+	return v
+}
+
+func statsCmd() {
+	s := computeStats()
+	fmt.Printf("Urls: %d\n", s.Urls)
+	for _, ss := range s.Sizes() {
+		fmt.Printf("%-12s %8d rows %12d bytes\n", ss.Name, ss.Count, ss.Bytes)
+	}
+	fmt.Printf("%-12s %8s      %12d bytes\n", "total", "", s.Total())
+	fmt.Printf("Average chain length: %.2f revisions\n", s.AvgChainLength)
+	fmt.Printf("Compression ratio: %.3f\n", s.CompressionRate)
+	fmt.Printf("Resource dedupe savings: %d bytes\n", s.DedupeSavings)
+	fmt.Printf("\nTop urls by size:\n")
+	for _, u := range s.TopUrls {
+		fmt.Printf("%12d\t%d\t%d revisions\t%s\n", u.Bytes, u.Id, u.Count, u.Name)
+	}
+	fmt.Printf("\nTop domains by size:\n")
+	for _, d := range s.TopDomains {
+		fmt.Printf("%12d\t%d urls\t%s\n", d.Bytes, d.Count, d.Name)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage for the archive: urls and their metadata, revisions, the text extracted from them, additional resources and the full text index.
+// The SQLite store, optionally keeping blobs in a directory, implements it together with MaintenanceStore and SavedSearchStore.
+type Store interface {
+	// Gets informations pertaining url if present, otherwise adds it
+	Lookup(url string, important bool, lastVisit int) Url
+	FindUrl(url string) (id int, ok bool)
+	GetUrl(id int) (Url, bool)
+	// Lists all urls except the subpages that were only retrieved crawling other urls
+	ListUrls() []Url
+	// Returns the ids of all urls with stored content
+	ListUrlIds() []int
+	CountUrls() int
+	// Removes u with its crawl configuration, subpages and tags, but not its revisions and text
+	RemoveUrl(u *Url)
+	// Records that u was given as input, so that it's listed even if it's also a subpage of another url
+	SetBookmarked(u *Url)
+	SetContentType(u *Url, mimeType string)
+	// Replaces the tags of u
+	SetTags(u *Url, tags []string)
+	Tags(u *Url) []string
+	// Returns the crawl depth and page cap for u, ok is false if they were never set
+	GetCrawlConfig(u *Url) (depth, maxPages int, ok bool)
+	SetCrawlConfig(u *Url, depth, maxPages int)
+	AddSubpage(parent, sub *Url)
+	ListSubpages(u *Url) []Url
+
+	// Returns the revision of u current at atDate (the last one if atDate < 0) and the number of diffs since the last full revision, not ok if there is none or it can not be reconstructed
+	GetContent(u *Url, atDate int) ([]byte, int, bool)
+	// Returns the stored revisions of u as they are in the store, oldest first. Revisions whose content can not be read have Err set
+	StoredRevisions(u *Url) []StoredRevision
+	ListRevisions(u *Url) []Revision
+	InsertRevision(u *Url, rev StoredRevision)
+	// Replaces the single revision of an unimportant url
+	UpdateRevision(u *Url, rev StoredRevision)
+	DeleteRevisions(u *Url)
+	StoredSize(u *Url) int
+
+	// Stores the text extracted from the revision of u retrieved at retrieved, its language and the stems of its words
+	StoreText(u *Url, retrieved int, title, text, language, stems string)
+	// Returns the text extracted from the last revision of u and its language
+	GetText(u *Url) (title, text, language string, ok bool)
+	// Removes the text of revisions of u that are no longer stored
+	DeleteStaleText(u *Url)
+
+	// Stores content as an additional resource and returns its id
+	StoreResource(url, contentType string, content []byte) string
+	// Returns an additional resource as stored, compressed with codec, not ok if there is none or its content can not be read
+	GetResource(id string) (contentType string, content []byte, codec string, ok bool)
+	ListResourceIds() []string
+	// Changes the id of an additional resource, also in the resource history
+	RenameResource(oldId, newId string)
+	// Records that the resource url referenced by pageUrl was not stored and why
+	RecordSkippedResource(pageUrl, url, reason string, retrieved int)
+	ListSkippedResources(pageUrl string) []SkippedResource
+	// Lists the archived pages that had resources missing when they were captured, most missing first
+	ListPagesMissingResources() []PageMissingResources
+	// Records that the resource url was fetched at fetched with contentId as its content
+	RecordResourceFetch(url, contentId string, fetched int)
+	// Returns the id of the content of resource url fetched closest to date
+	ClosestResource(url string, date int) (contentId string, ok bool)
+
+	// Returns the results of the search sq from offset (all of them if limit < 0), best first, and the total number of results
+	Search(sq *searchQuery, offset, limit int) ([]Result, int, error)
+	// Counts the urls matching sq by domain, capture date, importance, tag and content type
+	Facets(sq *searchQuery) ([]Facet, error)
+
+	Begin()
+	Commit()
+	Rollback()
+}
+
+// Statistics, consistency checks and reclaiming space, for the stats, fsck, repair and repack commands
+type MaintenanceStore interface {
+	// Counts the full revisions, diffs and additional resources and the bytes they use, wherever their content is kept
+	ContentSizes() (content, diffs, additional SizeStat)
+	// Counts the revisions of every url and the bytes they use
+	UrlSizes() []SizeStat
+	// Returns the bytes of additional resources that would have been stored again without content addressing
+	DedupeSavings() int
+	// Counts the revisions in the full text index and the bytes it uses
+	IndexSize() SizeStat
+	// Deletes the blobs no longer referenced by revisions or resources, returns how many were deleted and their size
+	CollectGarbage() (blobs, bytes int)
+	// Returns the ids of urls without revisions, left by interrupted updates
+	UrlsWithoutContent() []int
+	// Returns the ids of urls with revisions but no extracted text
+	UrlsWithoutText() []int
+	// Checks that urls, revisions and their extracted text agree, and that the full text index matches the text
+	CheckIndex() []fsckProblem
+	// Rebuilds the full text index from the extracted text
+	RebuildIndex()
+	// Gives back to the system the space freed deleting data
+	Compact()
+}
+
+// Saved searches and the revisions they matched
+type SavedSearchStore interface {
+	// Saves the search query, returns its id
+	AddSavedSearch(query string, created int) int
+	// Removes a saved search and its hits
+	RemoveSavedSearch(id int)
+	ListSavedSearches() []SavedSearch
+	// Records that the revision of url urlId retrieved at retrieved matches the saved search searchId, returns false if it was already recorded
+	AddSearchHit(searchId, urlId, retrieved, found int) bool
+	// Records that the saved search was run on the revisions retrieved up to checkedUntil
+	SetSearchChecked(searchId, checkedUntil int)
+	// Lists the hits of saved searches not marked as seen, newest first
+	ListNewHits() []SearchHit
+	MarkHitsSeen()
+}
+
+// A revision as it is stored, Content is compressed with Codec and is a diff if IsDiff is set
+type StoredRevision struct {
+	Revision
+	Hash    string
+	Content []byte
+	Err     error // set if Content could not be read
+}
+
+var archive Store
+
+// Returns the maintenance operations of the archive, exits if its store doesn't have them
+func archiveMaintenance() MaintenanceStore {
+	m, ok := archive.(MaintenanceStore)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "The store of this archive has no maintenance operations\n")
+		os.Exit(1)
+	}
+	return m
+}
+
+// Where a store keeps the content of revisions and resources. put returns what goes in the content column and a reference to the blob if it was stored elsewhere, ref is empty for blobs kept inline
+type blobStorage interface {
+	put(content []byte) (inline []byte, ref string)
+	get(inline []byte, ref string) ([]byte, error)
+	size(inlineSize int, ref string) int
+	// Deletes the blobs that are not in referenced and were not written recently
+	removeUnreferenced(referenced map[string]bool) (blobs, bytes int)
+}
+
+// Blobs written less than this many seconds ago are never garbage collected, a transaction storing a reference to them may not be committed yet
+const BLOB_GC_MIN_AGE = 60 * 60
+
+// Keeps blobs in the database
+type inlineBlobs struct{}
+
+func (inlineBlobs) put(content []byte) ([]byte, string) {
+	return content, ""
+}
+
+func (inlineBlobs) get(inline []byte, ref string) ([]byte, error) {
+	if ref != "" {
+		return nil, fmt.Errorf("blob %s is stored outside the database, use -blobs", ref)
+	}
+	return inline, nil
+}
+
+func (inlineBlobs) size(inlineSize int, ref string) int {
+	return inlineSize
+}
+
+func (inlineBlobs) removeUnreferenced(referenced map[string]bool) (int, int) {
+	return 0, 0
+}
+
+// Keeps blobs in a content addressed directory, blobs already in the database are still read from there
+type dirBlobs struct {
+	dir string
+}
+
+func (b dirBlobs) path(ref string) string {
+	h := strings.TrimPrefix(ref, SHA256_PREFIX)
+	if len(h) < 2 {
+		panic(fmt.Errorf("bad blob reference %q", ref))
+	}
+	return filepath.Join(b.dir, h[:2], h)
+}
+
+func (b dirBlobs) put(content []byte) ([]byte, string) {
+	ref := contentAddressableId(content)
+	p := b.path(ref)
+	if _, err := os.Stat(p); err == nil {
+		// keeps the garbage collector away from it until the reference is committed
+		now := time.Now()
+		os.Chtimes(p, now, now)
+		return []byte{}, ref
+	}
+	must(os.MkdirAll(filepath.Dir(p), 0755))
+	tmp := p + ".tmp"
+	must(ioutil.WriteFile(tmp, content, 0644))
+	must(os.Rename(tmp, p))
+	return []byte{}, ref
+}
+
+func (b dirBlobs) get(inline []byte, ref string) ([]byte, error) {
+	if ref == "" {
+		return inline, nil
+	}
+	if len(strings.TrimPrefix(ref, SHA256_PREFIX)) < 2 {
+		return nil, fmt.Errorf("bad blob reference %q", ref)
+	}
+	return ioutil.ReadFile(b.path(ref))
+}
+
+func (b dirBlobs) size(inlineSize int, ref string) int {
+	if ref == "" {
+		return inlineSize
+	}
+	fi, err := os.Stat(b.path(ref))
+	if err != nil {
+		return 0
+	}
+	return int(fi.Size())
+}
+
+func (b dirBlobs) removeUnreferenced(referenced map[string]bool) (blobs, bytes int) {
+	cutoff := time.Now().Add(-BLOB_GC_MIN_AGE * time.Second)
+	must(filepath.Walk(b.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || fi.ModTime().After(cutoff) {
+			return nil
+		}
+		// leftovers of blobs that were being written when the program stopped are also removed
+		if !strings.HasSuffix(p, ".tmp") && referenced[SHA256_PREFIX+fi.Name()] {
+			return nil
+		}
+		must(os.Remove(p))
+		blobs++
+		bytes += int(fi.Size())
+		return nil
+	}))
+	return blobs, bytes
+}
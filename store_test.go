@@ -0,0 +1,76 @@
+package main
+
+import (
+	"code.google.com/p/gosqlite/sqlite"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Opens an empty archive in a temporary directory, keeping blobs in blobsDir if it isn't empty
+func openTestArchive(t *testing.T, blobsDir string) {
+	dbFile := filepath.Join(t.TempDir(), "ua.sqlite")
+	var err error
+	dbConn, err = sqlite.Open(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbConn.Close() })
+	if blobsDir != "" {
+		archive = NewDirStore(dbConn, blobsDir)
+	} else {
+		archive = NewSQLiteStore(dbConn)
+	}
+	if err := migrateDatabase(dbFile); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMissingResourceBlob(t *testing.T) {
+	blobs := t.TempDir()
+	openTestArchive(t, blobs)
+	content := []byte("body { color: red; }")
+	id := StoreContentAddressable("http://example.com/style.css", "text/css", content)
+
+	contentType, got, ok := GetContentAddressable(id)
+	if !ok || contentType != "text/css" || string(got) != string(content) {
+		t.Fatalf("resource read as %q %q %v", contentType, got, ok)
+	}
+
+	// the same database without -blobs
+	archive = NewSQLiteStore(dbConn)
+	if _, _, ok := GetContentAddressable(id); ok {
+		t.Errorf("resource kept in a blob read without the blob directory")
+	}
+
+	archive = NewDirStore(dbConn, blobs)
+	must(os.RemoveAll(blobs))
+	if _, _, ok := GetContentAddressable(id); ok {
+		t.Errorf("resource read after deleting its blob")
+	}
+}
+
+func TestClosestResource(t *testing.T) {
+	openTestArchive(t, "")
+	archive.RecordResourceFetch("http://example.com/style.css", "first", 1000)
+	archive.RecordResourceFetch("http://example.com/style.css", "second", 2000)
+
+	tests := []struct {
+		date int
+		id   string
+	}{
+		{500, "first"}, // captured later, nothing older
+		{1000, "first"},
+		{1999, "first"}, // closer to the second, which didn't exist yet
+		{2000, "second"},
+		{5000, "second"},
+	}
+	for _, test := range tests {
+		if id, ok := archive.ClosestResource("http://example.com/style.css", test.date); !ok || id != test.id {
+			t.Errorf("resource at %d is %q, want %q", test.date, id, test.id)
+		}
+	}
+	if _, ok := archive.ClosestResource("http://example.com/other.css", 1000); ok {
+		t.Errorf("resource found for a url never fetched")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/kr/binarydist"
+)
+
+// Diff encodings of the content table
+const DIFF_BSDIFF = "bsdiff"
+const DIFF_TOKENS = "tokens"
+
+// bsdiff from the last full revision instead of the previous revision, written by versions that didn't replay the chain of diffs
+const DIFF_BSDIFF_BASE = "bsdiff-base"
+
+// Maximum number of token insertions and deletions that tokenDiff will look for, past this the whole changed region is replaced
+const MAX_TOKEN_EDITS = 2000
+
+// Splits c into tokens ending at newlines or at the end of a tag, returns the start offset of each token followed by len(c)
+func tokenize(c []byte) []int {
+	starts := []int{0}
+	for i := range c {
+		if (c[i] == '\n' || c[i] == '>') && i+1 < len(c) {
+			starts = append(starts, i+1)
+		}
+	}
+	if len(c) == 0 {
+		return starts
+	}
+	return append(starts, len(c))
+}
+
+// Assigns to each distinct token an integer id, returns the id of every token of c
+func internTokens(c []byte, starts []int, ids map[string]int) []int {
+	r := make([]int, len(starts)-1)
+	for i := range r {
+		tok := string(c[starts[i]:starts[i+1]])
+		id, ok := ids[tok]
+		if !ok {
+			id = len(ids)
+			ids[tok] = id
+		}
+		r[i] = id
+	}
+	return r
+}
+
+type editOp int
+
+const (
+	editEq editOp = iota
+	editDel
+	editIns
+)
+
+// Myers' O(ND) diff of a and b in linear space, returns false if a and b differ by more than maxD insertions and deletions
+func myersDiff(a, b []int, maxD int) ([]editOp, bool) {
+	return myersSplit(a, b, maxD, make([]editOp, 0, len(a)+len(b)))
+}
+
+// Appends to ops the edits turning a into b, diffing separately the parts before and after a point on the shortest edit path. Fails if there are more than maxD edits, maxD < 0 is no limit
+func myersSplit(a, b []int, maxD int, ops []editOp) ([]editOp, bool) {
+	p := 0
+	for p < len(a) && p < len(b) && a[p] == b[p] {
+		p++
+	}
+	s := 0
+	for s < len(a)-p && s < len(b)-p && a[len(a)-1-s] == b[len(b)-1-s] {
+		s++
+	}
+	for i := 0; i < p; i++ {
+		ops = append(ops, editEq)
+	}
+	am, bm := a[p:len(a)-s], b[p:len(b)-s]
+
+	if len(am) == 0 || len(bm) == 0 {
+		if maxD >= 0 && len(am)+len(bm) > maxD {
+			return nil, false
+		}
+		for range am {
+			ops = append(ops, editDel)
+		}
+		for range bm {
+			ops = append(ops, editIns)
+		}
+	} else {
+		x, y, ok := myersMiddle(am, bm, maxD)
+		if !ok {
+			return nil, false
+		}
+		// the edits of both parts are fewer than the edits of the whole
+		ops, _ = myersSplit(am[:x], bm[:y], -1, ops)
+		ops, _ = myersSplit(am[x:], bm[y:], -1, ops)
+	}
+
+	for i := 0; i < s; i++ {
+		ops = append(ops, editEq)
+	}
+	return ops, true
+}
+
+// Returns a point on the shortest edit path from a to b, found extending paths from both ends until they meet, keeping only the furthest point reached on each diagonal.
+// a and b must not be empty, their first and last tokens must differ. Fails if there are more than maxD edits, maxD < 0 is no limit
+func myersMiddle(a, b []int, maxD int) (x, y int, ok bool) {
+	n, m := len(a), len(b)
+	steps := (n + m + 1) / 2
+	if maxD >= 0 && (maxD+1)/2 < steps {
+		steps = (maxD + 1) / 2
+	}
+	// vf is the furthest x reached from the start on each diagonal x-y, vb is the furthest distance from the end on each diagonal of the reversed sequences, -1 if not reached
+	off := steps + 1
+	vf, vb := make([]int, 2*steps+3), make([]int, 2*steps+3)
+	for i := range vf {
+		vf[i], vb[i] = -1, -1
+	}
+	vf[off+1], vb[off+1] = 0, 0
+	delta := n - m
+	odd := delta%2 != 0
+	// diagonals are skipped once their paths leave the edit graph
+	fStart, fEnd, bStart, bEnd := 0, 0, 0, 0
+
+	for d := 0; d <= steps; d++ {
+		for k := -d + fStart; k <= d-fEnd; k += 2 {
+			x := myersNext(vf, off+k, k == -d, k == d)
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			vf[off+k] = x
+			switch {
+			case x > n:
+				fEnd += 2
+			case y > m:
+				fStart += 2
+			case odd:
+				if i := off + delta - k; i >= 0 && i < len(vb) && vb[i] >= 0 && vb[i] <= n && x >= n-vb[i] {
+					return x, y, maxD < 0 || 2*d-1 <= maxD
+				}
+			}
+		}
+		for k := -d + bStart; k <= d-bEnd; k += 2 {
+			x := myersNext(vb, off+k, k == -d, k == d)
+			y := x - k
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x++
+				y++
+			}
+			vb[off+k] = x
+			switch {
+			case x > n:
+				bEnd += 2
+			case y > m:
+				bStart += 2
+			case !odd:
+				if i := off + delta - k; i >= 0 && i < len(vf) && vf[i] >= 0 && vf[i] <= n && vf[i] >= n-x {
+					if y := vf[i] - (delta - k); y >= 0 && y <= m {
+						return vf[i], y, maxD < 0 || 2*d <= maxD
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// Returns where the path on the diagonal at index i of v starts at the next step, moving down from the diagonal above or right from the one below
+func myersNext(v []int, i int, first, last bool) int {
+	if first || (!last && v[i-1] < v[i+1]) {
+		return v[i+1]
+	}
+	return v[i-1] + 1
+}
+
+// Computes the changes needed to transform o into c, working on tokens delimited by newlines and tag ends
+func tokenDiff(o, c []byte) []DecoratedChange {
+	ostarts, cstarts := tokenize(o), tokenize(c)
+	ids := map[string]int{}
+	a, b := internTokens(o, ostarts, ids), internTokens(c, cstarts, ids)
+
+	// common prefix and suffix are skipped before running the diff algorithm
+	p := 0
+	for p < len(a) && p < len(b) && a[p] == b[p] {
+		p++
+	}
+	s := 0
+	for s < len(a)-p && s < len(b)-p && a[len(a)-1-s] == b[len(b)-1-s] {
+		s++
+	}
+	am, bm := a[p:len(a)-s], b[p:len(b)-s]
+
+	ops, ok := myersDiff(am, bm, MAX_TOKEN_EDITS)
+	if !ok {
+		// replace the whole changed region
+		ops = make([]editOp, 0, len(am)+len(bm))
+		for range am {
+			ops = append(ops, editDel)
+		}
+		for range bm {
+			ops = append(ops, editIns)
+		}
+	}
+
+	r := []DecoratedChange{}
+	ia, ib := p, p
+	for i := 0; i < len(ops); {
+		if ops[i] == editEq {
+			ia++
+			ib++
+			i++
+			continue
+		}
+		sa, sb := ia, ib
+		for ; i < len(ops) && ops[i] != editEq; i++ {
+			if ops[i] == editDel {
+				ia++
+			} else {
+				ib++
+			}
+		}
+		ins := c[cstarts[sb]:cstarts[ib]]
+		r = append(r, DecoratedChange{A: ostarts[sa], Del: ostarts[ia] - ostarts[sa], Ins: len(ins), InsText: ins})
+	}
+	return r
+}
+
+func encodeChanges(changes []DecoratedChange) []byte {
+	out := bytes.NewBuffer([]byte{})
+	buf := make([]byte, binary.MaxVarintLen64)
+	writeVarint(out, len(changes), buf)
+	for _, ch := range changes {
+		writeVarint(out, ch.A, buf)
+		writeVarint(out, ch.Del, buf)
+		writeVarint(out, ch.Ins, buf)
+		out.Write(ch.InsText)
+	}
+	return out.Bytes()
+}
+
+func applyChanges(base []byte, changes []DecoratedChange) []byte {
+	out := bytes.NewBuffer(make([]byte, 0, len(base)))
+	pos := 0
+	for _, ch := range changes {
+		out.Write(base[pos:ch.A])
+		out.Write(ch.InsText)
+		pos = ch.A + ch.Del
+	}
+	out.Write(base[pos:])
+	return out.Bytes()
+}
+
+// Creates a diff from o to c using the specified encoding
+func diff(c, o []byte, encoding string) []byte {
+	if encoding == DIFF_TOKENS {
+		return encodeChanges(tokenDiff(o, c))
+	}
+	patch := bytes.NewBuffer([]byte{})
+	binarydist.Diff(bytes.NewReader(o), bytes.NewReader(c), patch)
+	return patch.Bytes()
+}
+
+// Applies a diff created with the specified encoding to base
+func applyDiff(base, changes []byte, encoding string) []byte {
+	if encoding == DIFF_TOKENS {
+		return applyChanges(base, decodeChanges(changes))
+	}
+	return patch(base, changes)
+}
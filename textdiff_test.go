@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func checkRoundTrip(t *testing.T, o, c []byte) {
+	t.Helper()
+	if r := applyDiff(o, diff(c, o, DIFF_TOKENS), DIFF_TOKENS); !bytes.Equal(r, c) {
+		t.Errorf("diff from %q to %q reconstructed as %q", o, c, r)
+	}
+}
+
+func TestTokenDiff(t *testing.T) {
+	tests := []struct{ o, c string }{
+		{"", ""},
+		{"", "a\nb\n"},
+		{"a\nb\n", ""},
+		{"a\nb\nc\n", "a\nb\nc\n"},
+		{"a\nb\nc\n", "a\nx\nc\n"},
+		{"a\nb\nc", "a\nb\nc\nd"},
+		{"a\nb\nc\n", "a\nb\nc"},
+		{"a\nb\nc", "a\nb\nc\n"},
+		{"no newline", "no newline either"},
+		{"<p>a</p><p>b</p>", "<p>a</p><p>c</p><p>b</p>"},
+		{"x\ny\nz\n", "z\ny\nx\n"},
+		{"\n\n\n", "\n"},
+	}
+	for _, test := range tests {
+		checkRoundTrip(t, []byte(test.o), []byte(test.c))
+	}
+}
+
+// Returns a text of n tokens drawn from few distinct ones, so that random texts share many of them
+func randomTokens(rnd *rand.Rand, n int) []byte {
+	toks := []string{"a\n", "b\n", "<p>", "</p>", "c", "\n", "dd\n", ">"}
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteString(toks[rnd.Intn(len(toks))])
+	}
+	return []byte(b.String())
+}
+
+func TestTokenDiffRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		checkRoundTrip(t, randomTokens(rnd, rnd.Intn(40)), randomTokens(rnd, rnd.Intn(40)))
+	}
+}
+
+func TestTokenDiffMaxEdits(t *testing.T) {
+	var o, c strings.Builder
+	for i := 0; i < MAX_TOKEN_EDITS; i++ {
+		fmt.Fprintf(&o, "old %d\n", i)
+		fmt.Fprintf(&c, "new %d\n", i)
+	}
+	// the changed region is between a common prefix and suffix
+	ob := []byte("head\n" + o.String() + "tail")
+	cb := []byte("head\n" + c.String() + "tail")
+
+	ids := map[string]int{}
+	a, b := internTokens(ob, tokenize(ob), ids), internTokens(cb, tokenize(cb), ids)
+	if _, ok := myersDiff(a, b, MAX_TOKEN_EDITS); ok {
+		t.Fatalf("myersDiff found a diff with more than %d edits", MAX_TOKEN_EDITS)
+	}
+	changes := tokenDiff(ob, cb)
+	if len(changes) != 1 || changes[0].A != len("head\n") {
+		t.Errorf("changed region not replaced as a whole: %d changes", len(changes))
+	}
+	checkRoundTrip(t, ob, cb)
+}
@@ -7,134 +7,271 @@ import (
 	"github.com/aarzilli/sandblast"
 	"golang.org/x/net/html"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 const debugProcessing = false
 
-// the algorithm that looks for diffs is shit I must throw away large urls or the algorithm would never end
+// the bsdiff algorithm is shit I must throw away large urls or the algorithm would never end, this doesn't apply to the tokens diff encoding
 const MAX_STORE_SIZE = 500 * 1024
 
+// Set when the user asked to stop the update, checked between urls
+var interruptRequested int32
+
+// Makes the first Ctrl-C stop the update after the url being processed is stored, a second Ctrl-C kills the program and the current url is rolled back
+func handleInterrupt() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	go func() {
+		<-ch
+		atomic.StoreInt32(&interruptRequested, 1)
+		signal.Stop(ch)
+		fmt.Fprintf(os.Stderr, "Interrupted, stopping after the current url (Ctrl-C again to abort it)\n")
+	}()
+}
+
+func interrupted() bool {
+	return atomic.LoadInt32(&interruptRequested) != 0
+}
+
+// What happened to a url given to update
+type fetchResult int
+
+const (
+	FETCH_FAILED    fetchResult = iota
+	FETCH_SKIPPED               // already archived, not fetched again
+	FETCH_UNCHANGED             // fetched, same content as the last revision
+	FETCH_STORED                // fetched, new or changed content stored
+)
+
+// Runs f, which stores a single url, inside a transaction so that a crash never leaves the url half stored. f must not access the network, the database is locked until it returns
+func urlTransaction(f func() (Url, fetchResult)) (u Url, res fetchResult) {
+	beginTransaction()
+	defer func() {
+		if err := recover(); err != nil {
+			rollbackTransaction()
+			panic(err)
+		}
+	}()
+	u, res = f()
+	commitTransaction()
+	return
+}
+
 func update() {
+	repairArchive()
+	handleInterrupt()
+
 	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
+	for !interrupted() && scanner.Scan() {
 		line := scanner.Text()
-		if len(line) <= 0 {
+		fields := strings.Fields(line)
+		if len(fields) <= 0 {
 			continue
 		}
-		if line[0] == '*' {
+		conf, opts := fields[0], fields[1:]
+		bookmark := func(urlDescr Url) {
+			urlDescr.SetBookmarked()
+			urlOptions(urlDescr, opts)
+		}
+		var urlDescr Url
+		var res fetchResult
+		if conf[0] == '*' {
 			// Important URL, store all diffs forever
-			fmt.Printf("Getting important url: %s\n", line[1:])
-			importantUrl(line[1:])
+			fmt.Printf("Getting important url: %s\n", conf[1:])
+			urlDescr, res = importantUrl(conf[1:], bookmark)
 		} else {
 			// Unimportant URL, store only first version
-			fmt.Printf("Getting unimportant url: %s\n", line)
-			unimportantUrl(line)
+			fmt.Printf("Getting unimportant url: %s\n", conf)
+			v := strings.SplitN(conf, ",", 2)
+			if len(v) != 2 {
+				fmt.Fprintf(os.Stderr, "Bad URL configuration line <%s>\n", line)
+				continue
+			}
+			lastVisit, err := strconv.Atoi(v[0])
+			if err != nil {
+				lastVisit = 0
+			}
+			urlDescr, res = unimportantUrl(v[1], lastVisit, bookmark)
+		}
+		if res == FETCH_STORED {
+			crawl(urlDescr)
 		}
 	}
 	must(scanner.Err())
+
+	beginTransaction()
+	hits := checkSavedSearches()
+	commitTransaction()
+	if hits > 0 {
+		fmt.Printf("%d new matches for saved searches, see urlarchive alerts\n", hits)
+	}
+}
+
+// Applies the options following the url on an input line
+func urlOptions(urlDescr Url, opts []string) {
+	depth, maxPages, _ := urlDescr.GetCrawlConfig()
+	setCrawl := false
+	for _, opt := range opts {
+		v := strings.SplitN(opt, "=", 2)
+		if len(v) != 2 {
+			fmt.Fprintf(os.Stderr, "\tBad option %q\n", opt)
+			continue
+		}
+		switch v[0] {
+		case "crawl", "maxpages":
+			n, err := strconv.Atoi(v[1])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "\tBad option %q\n", opt)
+				continue
+			}
+			if v[0] == "crawl" {
+				depth = n
+			} else {
+				maxPages = n
+			}
+			setCrawl = true
+		case "tags":
+			tags := []string{}
+			for _, tag := range strings.Split(v[1], ",") {
+				if tag != "" {
+					tags = append(tags, tag)
+				}
+			}
+			urlDescr.SetTags(tags)
+		default:
+			fmt.Fprintf(os.Stderr, "\tUnknown option %q\n", opt)
+		}
+	}
+	if setCrawl {
+		urlDescr.SetCrawlConfig(depth, maxPages)
+	}
 }
 
-// Important URL, store all diffs forever
-func importantUrl(url string) {
+// A page fetched and processed, with the resources fullStore downloaded for it, ready to be stored
+type fetchedPage struct {
+	fetched     []byte // as it was downloaded
+	content     []byte
+	title, text string
+	resources   *pageFetch
+}
+
+// Fetches url and, with -f, its resources. Nothing is written to the database
+func fetchPage(url string) (*fetchedPage, bool) {
 	if debugProcessing {
 		fmt.Printf("Fetching\n")
 	}
 	content, status, _, err := sandblast.FetchURL(url)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error fetching URL %s: %v\n", url, err)
-		return
+		return nil, false
 	}
 	if status != 200 {
 		fmt.Fprintf(os.Stderr, "Error fetching URL %s, status code %d\n", url, status)
-		return
+		return nil, false
 	}
 
-	content, title, text := contentProcessing(url, content)
+	p := &fetchedPage{fetched: content}
+	p.content, p.title, p.text, p.resources = contentProcessing(url, content)
+	return p, true
+}
 
-	if len(content) > MAX_STORE_SIZE {
-		fmt.Printf("URL Too Large: %s\n", url)
-		return
+// Stores the resources of the page, before its revision so that they are not newer than it
+func (p *fetchedPage) storeResources() {
+	if p.resources != nil {
+		p.resources.store()
 	}
+}
 
-	if debugProcessing {
-		fmt.Printf("Lookup\n")
+// Important URL, store all diffs forever. The page is fetched before starting the transaction that stores it, inside the transaction after is called with the stored url
+func importantUrl(url string, after func(Url)) (Url, fetchResult) {
+	p, ok := fetchPage(url)
+	if !ok {
+		return Url{}, FETCH_FAILED
 	}
-	urlDescr := Lookup(url, true, -1, true)
 
-	if debugProcessing {
-		fmt.Printf("Getting stored content\n")
+	if diffEncodingFlag == DIFF_BSDIFF && len(p.content) > MAX_STORE_SIZE {
+		fmt.Printf("URL Too Large: %s\n", url)
+		return Url{}, FETCH_FAILED
 	}
-	storedContent, diffs, ok := urlDescr.GetContent(-1)
 
-	if !ok || (diffs > MAX_DIFFS) {
+	return urlTransaction(func() (Url, fetchResult) {
 		if debugProcessing {
-			fmt.Printf("Compression\n")
+			fmt.Printf("Lookup\n")
 		}
-		cc, isgz := maybeCompress(content)
-		urlDescr.StoreContent(cc, false, isgz, true)
-	} else {
+		urlDescr := Lookup(url, true, -1)
+
+		p.storeResources()
+		retrieved, changed := urlDescr.StoreRevision(p.content)
+		urlDescr.SetContentType(p.fetched)
+
 		if debugProcessing {
-			fmt.Printf("Compression and diff\n")
+			fmt.Printf("Storing new content\n")
 		}
-		cc, isdiff, isgz := maybeDiffCompress(content, storedContent)
-		urlDescr.StoreContent(cc, isdiff, isgz, true)
-	}
+		urlDescr.StoreContent2(retrieved, p.title, p.text)
+		after(urlDescr)
+		if debugProcessing {
+			fmt.Printf("Done\n")
+		}
+		if !changed {
+			return urlDescr, FETCH_UNCHANGED
+		}
+		return urlDescr, FETCH_STORED
+	})
+}
 
+// Stores content as a new revision of u, as a diff from the previous revision if there is one and the chain of diffs isn't too long. Returns the retrieval date of the new revision and whether its content differs from the previous one
+func (u *Url) StoreRevision(content []byte) (int, bool) {
 	if debugProcessing {
-		fmt.Printf("HTML Extraction\n")
-	}
-	if debugProcessing {
-		fmt.Printf("Storing new content\n")
-	}
-	urlDescr.StoreContent2(title, text)
-	if debugProcessing {
-		fmt.Printf("Done\n")
+		fmt.Printf("Getting stored content\n")
 	}
-}
-
-// Unimportant URL, store only first version
-func unimportantUrl(conf string) {
-	v := strings.SplitN(conf, ",", 2)
-	if len(v) != 2 {
-		fmt.Fprintf(os.Stderr, "Bad URL configuration line <%s>\n", conf)
-		return
+	storedContent, diffs, ok := u.GetContent(-1)
+	if !ok {
+		storedContent = nil
 	}
 
-	url := v[1]
-	time, err := strconv.Atoi(v[0])
-	if err != nil {
-		time = 0
-	}
+	cc, isdiff, codec, encoding := encodeRevision(content, storedContent, diffs)
+	return u.StoreContent(cc, isdiff, codec, encoding, contentAddressableId(content), true), !ok || !bytes.Equal(content, storedContent)
+}
 
-	urlDescr := Lookup(url, false, time, true)
-	if !urlDescr.IsNew {
+// Unimportant URL, store only first version. Urls already archived are skipped without fetching them, inside the transaction storing the url after is called with it
+func unimportantUrl(url string, lastVisit int, after func(Url)) (Url, fetchResult) {
+	if _, ok := findUrlId(url); ok {
 		fmt.Fprintf(os.Stderr, "\tskipped\n")
-		// already stored, skipping
-		return
+		// already stored, only its last visit is updated
+		return urlTransaction(func() (Url, fetchResult) {
+			urlDescr := Lookup(url, false, lastVisit)
+			after(urlDescr)
+			return urlDescr, FETCH_SKIPPED
+		})
 	}
 
-	content, status, _, err := sandblast.FetchURL(url)
-	if err != nil {
-		urlDescr.Remove()
-		fmt.Fprintf(os.Stderr, "Error fetching URL %s: %v\n", url, err)
-		return
-	}
-	if status != 200 {
-		urlDescr.Remove()
-		fmt.Fprintf(os.Stderr, "Error fetching URL %s status code %d]\n", url, status)
-		return
+	p, ok := fetchPage(url)
+	if !ok {
+		return Url{}, FETCH_FAILED
 	}
 
-	content, title, text := contentProcessing(url, content)
-
-	cc, isgz := maybeCompress(content)
-	urlDescr.StoreContent(cc, false, isgz, true)
-	urlDescr.StoreContent2(title, text)
+	return urlTransaction(func() (Url, fetchResult) {
+		urlDescr := Lookup(url, false, lastVisit)
+		after(urlDescr)
+		if !urlDescr.IsNew {
+			// stored by someone else while it was being fetched
+			return urlDescr, FETCH_SKIPPED
+		}
+		p.storeResources()
+		urlDescr.SetContentType(p.fetched)
+		cc, codec := maybeCompress(p.content)
+		retrieved := urlDescr.StoreContent(cc, false, codec, diffEncodingFlag, contentAddressableId(p.content), true)
+		urlDescr.StoreContent2(retrieved, p.title, p.text)
+		return urlDescr, FETCH_STORED
+	})
 }
 
-func contentProcessing(url string, content []byte) (rcontent []byte, title, text string) {
+// Extracts the text of content and, with -f, downloads its resources and points content to them. The downloaded resources are returned to be stored with the page
+func contentProcessing(url string, content []byte) (rcontent []byte, title, text string, resources *pageFetch) {
 	rcontent = content
 	htmlNode, err := html.Parse(bytes.NewReader(content))
 	if err != nil {
@@ -143,7 +280,7 @@ func contentProcessing(url string, content []byte) (rcontent []byte, title, text
 	}
 
 	if fullStoreFlag {
-		fullStore(url, htmlNode)
+		resources = fullStore(url, htmlNode)
 		var buf bytes.Buffer
 		err = html.Render(&buf, htmlNode)
 		if err != nil {
@@ -11,6 +11,9 @@ const MAX_DIFFS = 20
 const MINGAIN = 0.80
 
 var fullStoreFlag = false
+var diffEncodingFlag = DIFF_TOKENS
+var compressFlag = CODEC_ZSTD
+var blobsFlag = ""
 
 type DecoratedChange struct {
 	A, Ins, Del int
@@ -24,16 +27,55 @@ func must(err error) {
 }
 
 func usage() {
-	fmt.Fprintf(os.Stderr, "Usage: urlarchive [-f] [<archive db>] [serve|update]\n")
+	fmt.Fprintf(os.Stderr, "Usage: urlarchive [-f] [-diff tokens|bsdiff] [-compress zstd|gzip] [-blobs <dir>] [<archive db>] <command>\n")
 	fmt.Fprintf(os.Stderr, "\t-f\tRetrieves images and linked stylesheets too\n")
+	fmt.Fprintf(os.Stderr, "\t-diff\tEncoding used for new revisions of important urls, tokens (default) or bsdiff\n")
+	fmt.Fprintf(os.Stderr, "\t-compress\tCompression used for new content, zstd (default) or gzip\n")
+	fmt.Fprintf(os.Stderr, "\t-blobs\tKeeps the content of revisions and resources in this directory instead of the database\n")
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "\tserve\n")
+	fmt.Fprintf(os.Stderr, "\tupdate\n")
+	fmt.Fprintf(os.Stderr, "\tsearch [--json] [--limit <n>] <query>\tPrints id, url, title, date and snippet of the urls matching query\n")
+	fmt.Fprintf(os.Stderr, "\talerts [add <query>|remove <id>|list]\tPrints the new matches of saved searches, or manages them\n")
+	fmt.Fprintf(os.Stderr, "\texport-page <id> [--at <date>]\tWrites url <id> as a single HTML file to stdout\n")
+	fmt.Fprintf(os.Stderr, "\texport-mhtml <id> [--at <date>]\tWrites url <id> as a MHTML file to stdout\n")
+	fmt.Fprintf(os.Stderr, "\timport-mhtml <file>...\tImports MHTML files into the archive\n")
+	fmt.Fprintf(os.Stderr, "\tmissing\tLists pages whose resources could not be stored\n")
+	fmt.Fprintf(os.Stderr, "\trehash [--dry-run]\tMoves stored resources from SHA-1 to SHA-256 ids\n")
+	fmt.Fprintf(os.Stderr, "\trepack [--url <id>]\tRebuilds the stored revisions with the current settings and compacts the database\n")
+	fmt.Fprintf(os.Stderr, "\tstats\tShows where the space in the database goes\n")
+	fmt.Fprintf(os.Stderr, "\tprune-revisions [--policy <policy>] [--url <id>] [--dry-run]\tThins out old revisions of important urls\n")
+	fmt.Fprintf(os.Stderr, "\tfsck\tChecks the integrity of the archive\n")
+	fmt.Fprintf(os.Stderr, "\treindex [--url <id>]\tRebuilds the full text index of every revision\n")
+	fmt.Fprintf(os.Stderr, "\tmigrate [--dry-run]\tUpgrades the database schema, this is also done automatically by every other command\n")
 	os.Exit(1)
 }
 
+func newSubcommandFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = usage
+	return fs
+}
+
+// Parses the flags of a subcommand, unlike fs.Parse flags can follow positional arguments
+func parseSubcommandArgs(fs *flag.FlagSet, args []string) []string {
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			usage()
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
 func parseCmd(args []string) (string, []string) {
 	switch args[0] {
-	case "serve":
-		fallthrough
-	case "update":
+	case "serve", "update", "search", "alerts", "export-page", "export-mhtml", "import-mhtml", "missing", "rehash", "repack", "stats", "prune-revisions", "fsck", "reindex", "migrate":
 		return os.ExpandEnv("$HOME/.config/urlarchive/ua.sqlite"), args
 	default:
 		return args[0], args[1:]
@@ -42,8 +84,18 @@ func parseCmd(args []string) (string, []string) {
 
 func main() {
 	flag.BoolVar(&fullStoreFlag, "f", false, "Retrieves linked stylesheets and images")
+	flag.StringVar(&diffEncodingFlag, "diff", DIFF_TOKENS, "Encoding for new diffs, tokens or bsdiff")
+	flag.StringVar(&compressFlag, "compress", CODEC_ZSTD, "Compression for new content, zstd or gzip")
+	flag.StringVar(&blobsFlag, "blobs", "", "Directory for the content of revisions and resources")
 	flag.Parse()
 
+	if diffEncodingFlag != DIFF_TOKENS && diffEncodingFlag != DIFF_BSDIFF {
+		usage()
+	}
+	if compressFlag != CODEC_ZSTD && compressFlag != CODEC_GZIP {
+		usage()
+	}
+
 	args := flag.Args()
 
 	if len(args) < 1 {
@@ -51,17 +103,60 @@ func main() {
 	}
 
 	dbFile, args := parseCmd(args)
+	if len(args) < 1 {
+		usage()
+	}
 
 	var err error
 	dbConn, err = sqlite.Open(dbFile)
 	must(err)
 	defer dbConn.Close()
-	must(createDatabase())
+
+	if blobsFlag != "" {
+		archive = NewDirStore(dbConn, blobsFlag)
+	} else {
+		archive = NewSQLiteStore(dbConn)
+	}
+
+	if args[0] == "migrate" {
+		migrateCmd(dbFile, args[1:])
+		return
+	}
+	if err := migrateDatabase(dbFile); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not upgrade database: %v\n", err)
+		os.Exit(1)
+	}
 
 	switch args[0] {
 	case "serve":
 		serve()
 	case "update":
 		update()
+	case "search":
+		searchCmd(args[1:])
+	case "alerts":
+		alertsCmd(args[1:])
+	case "export-page":
+		exportPageCmd(args[1:])
+	case "export-mhtml":
+		exportMHTMLCmd(args[1:])
+	case "import-mhtml":
+		importMHTMLCmd(args[1:])
+	case "missing":
+		missingResourcesCmd()
+	case "rehash":
+		rehashCmd(args[1:])
+	case "repack":
+		repackCmd(args[1:])
+	case "stats":
+		statsCmd()
+	case "prune-revisions":
+		pruneRevisionsCmd(args[1:])
+	case "fsck":
+		fsckCmd()
+	case "reindex":
+		reindexCmd(args[1:])
+	default:
+		usage()
 	}
 }